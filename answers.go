@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Suffix of answer files next to build scripts.
+const answersSuffix = ".answers"
+
+// Default time to wait for an expected pattern.
+const defaultAnswerTimeout = 5 * time.Minute
+
+// Amount of recent output kept for pattern matching.
+const answerBufSize = 64 * 1024
+
+// An Answer is a response sent to an interactive command once its output
+// matches the expected pattern. A nil pattern means the response is sent
+// right away.
+type Answer struct {
+	expect  *regexp.Regexp
+	send    []string
+	timeout time.Duration
+}
+
+// parseAnswers parses an answer file. Each line is one of:
+//
+//	expect "regexp"
+//	send "response\r"
+//	timeout 30s
+//
+// Arguments are Go quoted strings. Every send belongs to the preceding
+// expect, and a timeout applies to the following expects. The timeout in
+// effect at the end also limits the time without output once all answers
+// have been sent, and is returned as the idle timeout. Blank lines and lines
+// starting with '#' are ignored.
+func parseAnswers(r io.Reader) (answers []Answer, idle time.Duration, err error) {
+	timeout := defaultAnswerTimeout
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, 0, fmt.Errorf("line %d: missing argument", n)
+		}
+		keyword, arg := fields[0], strings.TrimSpace(fields[1])
+
+		if keyword == "timeout" {
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				return nil, 0, fmt.Errorf("line %d: invalid "+
+					"timeout %q", n, arg)
+			}
+			timeout = d
+			continue
+		}
+
+		value, err := strconv.Unquote(arg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: invalid quoted "+
+				"string %s", n, arg)
+		}
+		switch keyword {
+		case "expect":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: %s", n, err)
+			}
+			answers = append(answers, Answer{
+				expect:  re,
+				timeout: timeout,
+			})
+		case "send":
+			if len(answers) == 0 {
+				answers = append(answers, Answer{})
+			}
+			a := &answers[len(answers)-1]
+			a.send = append(a.send, value)
+		default:
+			return nil, 0, fmt.Errorf("line %d: unknown keyword %q",
+				n, keyword)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, 0, err
+	}
+	return answers, timeout, nil
+}
+
+// ReadAnswers reads the given answer file, returning the answers and the
+// idle timeout.
+func ReadAnswers(pathname string) ([]Answer, time.Duration, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	answers, idle, err := parseAnswers(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", pathname, err)
+	}
+	return answers, idle, nil
+}
+
+// answerPty feeds the answers to a command running on the pseudo-terminal
+// whose master end is given, and logs the command's output with the given
+// function. If an expected pattern does not show up in time, or the command
+// stops producing output for the idle timeout once all answers have been
+// sent, such as at an unexpected prompt, the command is killed. It returns
+// when the command has closed the terminal.
+func answerPty(master *os.File, answers []Answer, idle time.Duration,
+	logf func(format string, v ...interface{}), kill func()) error {
+	tw := &transcriptWriter{prefix: "[pty]", logf: logf}
+	defer tw.Close()
+
+	// Read the output in the background, so that waiting for it can
+	// time out.
+	output := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(output)
+		for {
+			buf := make([]byte, 4096)
+			n, err := master.Read(buf)
+			if n > 0 {
+				output <- buf[:n]
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var err error
+	var recent []byte
+	var timer <-chan time.Time
+	step, timerStep := 0, -1
+	killed := false
+	for {
+		// Send responses until the next unmatched pattern.
+		for ; step < len(answers); step++ {
+			a := answers[step]
+			if a.expect != nil {
+				m := a.expect.FindIndex(recent)
+				if m == nil {
+					break
+				}
+				recent = recent[m[1]:]
+				Debugf("Matched expected %q.", a.expect)
+			}
+			for _, s := range a.send {
+				if _, err := io.WriteString(master, s); err != nil {
+					Errorf("Sending answer: %s", err)
+				}
+			}
+		}
+		switch {
+		case killed:
+		case step < len(answers):
+			if step != timerStep {
+				timer = time.After(answers[step].timeout)
+				timerStep = step
+			}
+		default:
+			// Restarted by each output.
+			timer = time.After(idle)
+		}
+
+		select {
+		case data, ok := <-output:
+			if !ok {
+				if rerr := <-readErr; !isEIO(rerr) && rerr != io.EOF {
+					err = rerr
+				}
+				if err == nil && step < len(answers) {
+					Warningf("Command finished before %q was "+
+						"matched.", answers[step].expect)
+				}
+				return err
+			}
+			tw.Write(data)
+			recent = append(recent, data...)
+			recent = ansiEscapeRe.ReplaceAll(recent, nil)
+			if len(recent) > answerBufSize {
+				recent = recent[len(recent)-answerBufSize:]
+			}
+		case <-timer:
+			if step < len(answers) {
+				err = fmt.Errorf("timed out after %s waiting for %q",
+					answers[step].timeout, answers[step].expect)
+			} else {
+				err = fmt.Errorf("no output for %s after the last "+
+					"answer", idle)
+			}
+			Errorf("Answering: %s", err)
+			kill()
+			// Keep draining the output until the command is gone.
+			step = len(answers)
+			killed = true
+			timer = nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAnswers(t *testing.T) {
+	in := `# Unattended setup.
+send "start\n"
+expect "Name: $"
+send "bob\r"
+timeout 30s
+expect "Continue\\? \\[y/N\\]"
+send "y"
+send "\r"
+timeout 1m
+`
+	answers, idle, err := parseAnswers(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("parseAnswers failed: %s", err)
+	}
+	if idle != time.Minute {
+		t.Fatalf("parseAnswers: got idle timeout %s, want 1m", idle)
+	}
+	if len(answers) != 3 {
+		t.Fatalf("parseAnswers: got %d answers, want 3", len(answers))
+	}
+	if answers[0].expect != nil || len(answers[0].send) != 1 ||
+		answers[0].send[0] != "start\n" {
+		t.Fatalf("Answer 0: got %+v", answers[0])
+	}
+	if answers[1].expect.String() != "Name: $" ||
+		answers[1].timeout != defaultAnswerTimeout ||
+		answers[1].send[0] != "bob\r" {
+		t.Fatalf("Answer 1: got %+v", answers[1])
+	}
+	if !answers[2].expect.MatchString("Continue? [y/N]") ||
+		answers[2].timeout != 30*time.Second ||
+		strings.Join(answers[2].send, "") != "y\r" {
+		t.Fatalf("Answer 2: got %+v", answers[2])
+	}
+
+	for _, in := range []string{
+		"expect",
+		"expect unquoted",
+		`expect "("`,
+		"timeout forever",
+		`reply "y"`,
+	} {
+		if _, _, err := parseAnswers(strings.NewReader(in)); err == nil {
+			t.Fatalf("parseAnswers(%q) did not fail.", in)
+		}
+	}
+}
+
+func TestAnswerPtyIdle(t *testing.T) {
+	master, slave, err := OpenPty()
+	if err != nil {
+		t.Skipf("OpenPty: %s", err)
+	}
+	defer master.Close()
+
+	// The command prompts again after the last answer, and then waits.
+	answers, idle, err := parseAnswers(strings.NewReader(
+		"expect \"Name: \"\nsend \"bob\\n\"\ntimeout 200ms\n"))
+	if err != nil {
+		t.Fatalf("parseAnswers failed: %s", err)
+	}
+	slave.WriteString("Name: ")
+	killed := make(chan bool, 1)
+	kill := func() {
+		killed <- true
+		slave.WriteString("Again: ")
+		slave.Close()
+	}
+	logf := func(format string, v ...interface{}) {}
+
+	err = answerPty(master, answers, idle, logf, kill)
+	if err == nil || !strings.Contains(err.Error(), "no output for 200ms") {
+		t.Fatalf("answerPty: got %v, want idle timeout", err)
+	}
+	select {
+	case <-killed:
+	default:
+		t.Fatalf("Command not killed.")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Directory holding binfmt_misc registrations.
+const binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// Arch describes a target architecture. The name follows Debian
+// conventions, and qemu is the qemu-user name of the architecture.
+type Arch struct {
+	name    string
+	aliases []string
+	machine elf.Machine
+	class   elf.Class
+	order   binary.ByteOrder
+	qemu    string
+}
+
+// Architectures known to rib.
+var archTable = []*Arch{
+	{"amd64", []string{"x86_64"},
+		elf.EM_X86_64, elf.ELFCLASS64, binary.LittleEndian, "x86_64"},
+	{"i386", []string{"386", "i686"},
+		elf.EM_386, elf.ELFCLASS32, binary.LittleEndian, "i386"},
+	{"arm64", []string{"aarch64"},
+		elf.EM_AARCH64, elf.ELFCLASS64, binary.LittleEndian, "aarch64"},
+	{"armhf", []string{"arm", "armel", "armv7l"},
+		elf.EM_ARM, elf.ELFCLASS32, binary.LittleEndian, "arm"},
+	{"ppc64el", []string{"ppc64le"},
+		elf.EM_PPC64, elf.ELFCLASS64, binary.LittleEndian, "ppc64le"},
+	{"s390x", nil,
+		elf.EM_S390, elf.ELFCLASS64, binary.BigEndian, "s390x"},
+	{"riscv64", nil,
+		elf.EM_RISCV, elf.ELFCLASS64, binary.LittleEndian, "riscv64"},
+}
+
+// Binaries inspected to determine the architecture of a root filesystem.
+var archProbeFiles = []string{
+	"/bin/sh",
+	"/usr/bin/env",
+	"/bin/busybox",
+	"/sbin/init",
+}
+
+// LookupArch finds an architecture by its name or one of its aliases.
+func LookupArch(name string) *Arch {
+	for _, a := range archTable {
+		if a.name == name || StringInSlice(name, a.aliases) {
+			return a
+		}
+	}
+	return nil
+}
+
+// HostArch returns the architecture rib is running on.
+func HostArch() *Arch {
+	return LookupArch(runtime.GOARCH)
+}
+
+// elfArch returns the architecture of the given ELF file.
+func elfArch(f *elf.File) *Arch {
+	for _, a := range archTable {
+		if f.Machine == a.machine && f.Class == a.class &&
+			f.ByteOrder == a.order {
+			return a
+		}
+	}
+	return nil
+}
+
+// RootfsArch determines the architecture of a root filesystem by inspecting
+// well-known binaries inside it. It returns nil if the root filesystem holds
+// no recognizable binaries yet.
+func RootfsArch(rootfs string) (*Arch, error) {
+	for _, probe := range archProbeFiles {
+		pathname, err := ResolveInRoot(rootfs, probe)
+		if err != nil {
+			continue
+		}
+		f, err := elf.Open(pathname)
+		if err != nil {
+			continue
+		}
+		a := elfArch(f)
+		m := f.Machine
+		f.Close()
+		if a == nil {
+			return nil, fmt.Errorf("unknown architecture %s in '%s'",
+				m, probe)
+		}
+		return a, nil
+	}
+	return nil, nil
+}
+
+// binfmtEntry holds the relevant parts of a binfmt_misc registration.
+type binfmtEntry struct {
+	enabled     bool
+	interpreter string
+	flags       string
+}
+
+// readBinfmtEntry reads the binfmt_misc registration for qemu-user
+// emulation of the given architecture.
+func readBinfmtEntry(a *Arch) (*binfmtEntry, error) {
+	f, err := os.Open(filepath.Join(binfmtMiscDir, "qemu-"+a.qemu))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &binfmtEntry{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		switch {
+		case len(fields) == 1 && fields[0] == "enabled":
+			entry.enabled = true
+		case len(fields) == 2 && fields[0] == "interpreter":
+			entry.interpreter = fields[1]
+		case len(fields) == 2 && fields[0] == "flags:":
+			entry.flags = fields[1]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// isStaticELF checks whether the given file is a statically linked ELF
+// executable.
+func isStaticELF(pathname string) bool {
+	f, err := elf.Open(pathname)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return false
+		}
+	}
+	return true
+}
+
+// findStaticQemu locates a statically linked qemu-user interpreter on the
+// host, preferring the one registered with binfmt_misc.
+func findStaticQemu(a *Arch, registered string) (string, error) {
+	if registered != "" && isStaticELF(registered) {
+		return registered, nil
+	}
+	pathname, err := exec.LookPath("qemu-" + a.qemu + "-static")
+	if err != nil {
+		return "", err
+	}
+	if !isStaticELF(pathname) {
+		return "", fmt.Errorf("'%s' is not statically linked", pathname)
+	}
+	return pathname, nil
+}
+
+// SetupEmulation prepares the chroot for running foreign architecture
+// binaries through qemu-user emulation. If the kernel does not preload the
+// interpreter registered with binfmt_misc, a static copy is injected into the
+// root filesystem. The returned function removes anything injected, and must
+// be called after the command has finished.
+func (ce *CmdEnv) SetupEmulation() (cleanup func(), err error) {
+	cleanup = func() {}
+
+	target, err := RootfsArch(ce.chrootDir)
+	if err != nil {
+		Errorf("RootfsArch: %s", err)
+		return cleanup, err
+	}
+	if target == nil {
+		return cleanup, nil
+	}
+	if ce.arch != "" && LookupArch(ce.arch) != target {
+		Warningf("Target architecture '%s' differs from rootfs "+
+			"architecture '%s'.", ce.arch, target.name)
+	}
+	if host := HostArch(); host == target {
+		return cleanup, nil
+	}
+	Debugf("Foreign rootfs architecture '%s'; using qemu-%s.",
+		target.name, target.qemu)
+
+	entry, err := readBinfmtEntry(target)
+	if err != nil {
+		Errorf("No binfmt_misc registration for qemu-%s: %s",
+			target.qemu, err)
+		return cleanup, err
+	}
+	if !entry.enabled {
+		Errorf("The binfmt_misc registration for qemu-%s is disabled.",
+			target.qemu)
+		return cleanup, errors.New("binfmt_misc registration disabled")
+	}
+	if entry.interpreter == "" {
+		return cleanup, errors.New("binfmt_misc interpreter not found")
+	}
+
+	// With the fix-binary flag, the kernel opens the interpreter at
+	// registration time, so nothing needs to exist inside the chroot.
+	if strings.ContainsRune(entry.flags, 'F') {
+		Debugf("Interpreter '%s' is preloaded by binfmt_misc.",
+			entry.interpreter)
+		return cleanup, nil
+	}
+
+	// Leave an interpreter installed in the rootfs alone.
+	dst := filepath.Join(ce.chrootDir, entry.interpreter)
+	if _, err := os.Lstat(dst); err == nil {
+		return cleanup, nil
+	}
+
+	src, err := findStaticQemu(target, entry.interpreter)
+	if err != nil {
+		Errorf("No static qemu-%s interpreter found: %s",
+			target.qemu, err)
+		return cleanup, err
+	}
+
+	// Create missing parent directories, remembering the topmost one.
+	var created string
+	for dir := filepath.Dir(dst); dir != ce.chrootDir; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		created = dir
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		Errorf("os.MkdirAll: %s", err)
+		return cleanup, err
+	}
+
+	Debugf("Injecting '%s' as '%s'.", src, dst)
+	if err := CopyFile(dst, src); err != nil {
+		Errorf("CopyFile: %s", err)
+		if created != "" {
+			os.RemoveAll(created)
+		}
+		return cleanup, err
+	}
+
+	cleanup = func() {
+		Debugf("Removing injected interpreter '%s'.", dst)
+		os.Remove(dst)
+		if created != "" {
+			os.RemoveAll(created)
+		}
+	}
+	return cleanup, nil
+}
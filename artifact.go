@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Version of the artifact manifest format.
+const artifactManifestVersion = 1
+
+// Valid artifact kinds, like "kernel" or "initrd".
+var artifactKindRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// A pendingArtifact is an artifact registered by a running command. It is
+// recorded once the command has finished.
+type pendingArtifact struct {
+	kind string
+	path string
+}
+
+// An Artifact is a build output recorded in the artifact manifest. The path
+// is relative to the work directory.
+type Artifact struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Script string `json:"script"`
+}
+
+// An ArtifactManifest lists the artifacts of a work directory.
+type ArtifactManifest struct {
+	Version   int        `json:"version"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// ReadArtifactManifest reads the artifact manifest of the work directory.
+// Entries whose files no longer exist are dropped. A missing manifest yields
+// an empty one.
+func ReadArtifactManifest(workDir string) (*ArtifactManifest, error) {
+	m := &ArtifactManifest{Version: artifactManifestVersion}
+	data, err := ioutil.ReadFile(filepath.Join(workDir, PATHNAME_DIST,
+		PATHNAME_ARTIFACTS))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %s", PATHNAME_ARTIFACTS, err)
+	}
+
+	artifacts := m.Artifacts[:0]
+	for _, a := range m.Artifacts {
+		if _, err := os.Stat(filepath.Join(workDir, a.Path)); err == nil {
+			artifacts = append(artifacts, a)
+		}
+	}
+	m.Artifacts = artifacts
+	return m, nil
+}
+
+// Write saves the artifact manifest in the dist directory.
+func (m *ArtifactManifest) Write(workDir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	pathname := filepath.Join(workDir, PATHNAME_DIST, PATHNAME_ARTIFACTS)
+	tmp := pathname + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pathname)
+}
+
+// Add records an artifact, replacing any earlier one with the same path.
+func (m *ArtifactManifest) Add(a Artifact) {
+	for i := range m.Artifacts {
+		if m.Artifacts[i].Path == a.Path {
+			m.Artifacts[i] = a
+			return
+		}
+	}
+	m.Artifacts = append(m.Artifacts, a)
+}
+
+// hashFile returns the size and hex-encoded SHA-256 digest of a file.
+func hashFile(pathname string) (int64, string, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hostPath maps a path registered by the command, like an artifact, to a
+// host path. Relative paths are relative to the work directory, whichever
+// way they are sent. Absolute paths of chroot commands are inside the chroot,
+// and paths within shares map to the share source, as the shares are removed
+// from the chroot once the command has finished.
+func (ce *CmdEnv) hostPath(pathname string) string {
+	if !filepath.IsAbs(pathname) {
+		return filepath.Join(ce.workDir, pathname)
+	}
+	if ce.flag&Echroot == 0 {
+		return filepath.Clean(pathname)
+	}
+	pathname = filepath.Clean(pathname)
+	for _, s := range ce.shares {
+		if rel, err := filepath.Rel(s.target, pathname); err == nil &&
+			rel != ".." && !strings.HasPrefix(rel, "../") {
+			return filepath.Join(ce.shareSource(s), rel)
+		}
+	}
+	rootfs := filepath.Join(ce.workDir, PATHNAME_ROOTFS)
+	if resolved, err := ResolveInRoot(rootfs, pathname); err == nil {
+		return resolved
+	}
+	return filepath.Join(rootfs, pathname)
+}
+
+// RecordArtifacts hashes the artifacts registered by the finished command,
+// and adds them to the manifest. Artifacts must be regular files within the
+// work directory.
+func (ce *CmdEnv) RecordArtifacts(m *ArtifactManifest) error {
+	for _, pa := range ce.artifacts {
+		pathname := ce.hostPath(pa.path)
+		rel, err := filepath.Rel(ce.workDir, pathname)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("artifact '%s' is outside the work "+
+				"directory", pa.path)
+		}
+		fi, err := os.Stat(pathname)
+		if err != nil {
+			return fmt.Errorf("artifact '%s': %s", pa.path, err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("artifact '%s' is not a regular file",
+				pa.path)
+		}
+
+		size, sum, err := hashFile(pathname)
+		if err != nil {
+			return err
+		}
+		Debugf("Recording %s artifact '%s'.", pa.kind, rel)
+		m.Add(Artifact{
+			Path:   rel,
+			Kind:   pa.kind,
+			Size:   size,
+			SHA256: sum,
+			Script: ce.name,
+		})
+	}
+	return nil
+}
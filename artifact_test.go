@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHostPath(t *testing.T) {
+	shares, err := parseShares(Directives{"share": {"dist:rw"}})
+	if err != nil {
+		t.Fatalf("parseShares failed: %s", err)
+	}
+	ce := &CmdEnv{workDir: "/w", shares: shares}
+	for _, tc := range []struct {
+		flag       int
+		path, want string
+	}{
+		{0, "dist/vmlinuz", "/w/dist/vmlinuz"},
+		{0, "/w/tmp/x", "/w/tmp/x"},
+		{Echroot, "dist/vmlinuz", "/w/dist/vmlinuz"},
+		{Echroot, "/.rib/dist/vmlinuz", "/w/dist/vmlinuz"},
+		{Echroot, "/.rib/files/a/../b", "/w/files/b"},
+		{Echroot, "/.ribx/y", "/w/rootfs/.ribx/y"},
+		{Echroot, "/boot/vmlinuz", "/w/rootfs/boot/vmlinuz"},
+	} {
+		ce.flag = tc.flag
+		if got := ce.hostPath(tc.path); got != tc.want {
+			t.Fatalf("hostPath(%q) with flags %d: got %q, want %q",
+				tc.path, tc.flag, got, tc.want)
+		}
+	}
+}
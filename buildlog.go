@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Format of build IDs, which sort by start time.
+const buildIDFormat = "20060102-150405"
+
+// Valid build IDs, with a suffix for builds started in the same second.
+var buildIDRe = regexp.MustCompile(`^\d{8}-\d{6}(\.\d+)?$`)
+
+// Outcomes of builds and scripts.
+const (
+	outcomeRunning     = "running"
+	outcomeSucceeded   = "succeeded"
+	outcomeFailed      = "failed"
+	outcomeInterrupted = "interrupted"
+)
+
+// A ScriptStatus is the outcome of a build script. Durations are in
+// nanoseconds.
+type ScriptStatus struct {
+	Name     string        `json:"name"`
+	Outcome  string        `json:"outcome"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// A BuildStatus is the outcome of a build, saved in its log directory, and
+// updated as scripts finish.
+type BuildStatus struct {
+	ID       string          `json:"id"`
+	PID      int             `json:"pid"`
+	DryRun   bool            `json:"dry_run,omitempty"`
+	Outcome  string          `json:"outcome"`
+	Error    string          `json:"error,omitempty"`
+	Start    time.Time       `json:"start"`
+	Duration time.Duration   `json:"duration"`
+	Scripts  []*ScriptStatus `json:"scripts"`
+}
+
+// A BuildLog holds the log files of a build, in its own directory below
+// log/builds: the combined text and JSON logs, a log per script, and the
+// build status.
+type BuildLog struct {
+	id     string
+	dir    string
+	text   *os.File
+	json   *os.File
+	script *os.File
+	status BuildStatus
+}
+
+// OpenBuildLog creates the log directory of a new build, opens its combined
+// logs, and adds them to the loggers. The log/build.log and log/build.json
+// symlinks are pointed to the new logs. A build.log file from before build
+// directories is kept as build.log.old.
+func OpenBuildLog(workDir string, start time.Time) (*BuildLog, error) {
+	logDir := filepath.Join(workDir, PATHNAME_LOG)
+	buildsDir := filepath.Join(logDir, PATHNAME_BUILDS)
+	if err := EnsureDir(buildsDir); err != nil {
+		return nil, err
+	}
+
+	// Pick a unique build ID.
+	bl := &BuildLog{}
+	base := start.UTC().Format(buildIDFormat)
+	for n := 0; ; n++ {
+		bl.id = base
+		if n > 0 {
+			bl.id = fmt.Sprintf("%s.%d", base, n)
+		}
+		bl.dir = filepath.Join(buildsDir, bl.id)
+		err := os.Mkdir(bl.dir, 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	var err error
+	if bl.text, err = openLogFile(filepath.Join(bl.dir,
+		PATHNAME_BUILDLOG)); err != nil {
+		return nil, err
+	}
+	if bl.json, err = openLogFile(filepath.Join(bl.dir,
+		PATHNAME_BUILDJSON)); err != nil {
+		bl.text.Close()
+		return nil, err
+	}
+
+	for _, name := range []string{PATHNAME_BUILDLOG, PATHNAME_BUILDJSON} {
+		link := filepath.Join(logDir, name)
+		if fi, err := os.Lstat(link); err == nil && fi.Mode().IsRegular() {
+			Infof("Keeping old log file '%s' as '%s.old'.", link, link)
+			if err := os.Rename(link, link+".old"); err != nil {
+				bl.text.Close()
+				bl.json.Close()
+				return nil, err
+			}
+		}
+		target := filepath.Join(PATHNAME_BUILDS, bl.id, name)
+		if err := replaceSymlink(target, link); err != nil {
+			Warningf("Linking '%s': %s", link, err)
+		}
+	}
+
+	// Only add the logs once nothing can fail.
+	AddLoggerOutput(bl.text, LevelDebug)
+	Transcript.AddOutput(bl.text, LevelDebug)
+	Std.AddJSONOutput(bl.json, LevelTrace)
+	Transcript.AddJSONOutput(bl.json, LevelTrace)
+	Infof("Build %s, logging to '%s'.", bl.id, bl.dir)
+
+	bl.status = BuildStatus{
+		ID:      bl.id,
+		PID:     os.Getpid(),
+		Outcome: outcomeRunning,
+		Start:   start,
+	}
+	if err := bl.writeStatus(); err != nil {
+		Warningf("Writing build status: %s", err)
+	}
+	return bl, nil
+}
+
+// writeStatus saves the build status.
+func (bl *BuildLog) writeStatus() error {
+	data, err := json.MarshalIndent(&bl.status, "", "  ")
+	if err != nil {
+		return err
+	}
+	pathname := filepath.Join(bl.dir, PATHNAME_BUILDSTATUS)
+	tmp := pathname + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pathname)
+}
+
+// SetDryRun marks the build as a dry run.
+func (bl *BuildLog) SetDryRun() {
+	bl.status.DryRun = true
+	if err := bl.writeStatus(); err != nil {
+		Warningf("Writing build status: %s", err)
+	}
+}
+
+// FinishScript records the outcome of the running script.
+func (bl *BuildLog) FinishScript(err error) {
+	n := len(bl.status.Scripts)
+	if n == 0 {
+		return
+	}
+	s := bl.status.Scripts[n-1]
+	s.Duration = time.Since(s.Start)
+	s.Outcome = outcomeSucceeded
+	if err != nil {
+		s.Outcome = outcomeFailed
+	}
+	if err := bl.writeStatus(); err != nil {
+		Warningf("Writing build status: %s", err)
+	}
+}
+
+// Finish records the outcome of the build.
+func (bl *BuildLog) Finish(err error) {
+	for _, s := range bl.status.Scripts {
+		if s.Outcome == outcomeRunning {
+			s.Duration = time.Since(s.Start)
+			s.Outcome = outcomeFailed
+		}
+	}
+	bl.status.Duration = time.Since(bl.status.Start)
+	bl.status.Outcome = outcomeSucceeded
+	if err != nil {
+		bl.status.Outcome = outcomeFailed
+		bl.status.Error = MaskSecrets(err.Error())
+	}
+	if err := bl.writeStatus(); err != nil {
+		Warningf("Writing build status: %s", err)
+	}
+}
+
+// ReadBuildStatus reads the status of a build. The build is reported as
+// interrupted if it is still marked as running, but its process is gone.
+func ReadBuildStatus(workDir, id string) (*BuildStatus, error) {
+	data, err := ioutil.ReadFile(filepath.Join(workDir, PATHNAME_LOG,
+		PATHNAME_BUILDS, id, PATHNAME_BUILDSTATUS))
+	if err != nil {
+		return nil, err
+	}
+	s := &BuildStatus{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %s", PATHNAME_BUILDSTATUS, err)
+	}
+	if s.Outcome == outcomeRunning && !processAlive(s.PID) {
+		s.Outcome = outcomeInterrupted
+	}
+	return s, nil
+}
+
+// PreviousDurations returns the duration of the last successful run of each
+// script in earlier builds, except for dry runs and the given current build.
+func PreviousDurations(workDir, current string) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	ids, err := ListBuilds(workDir)
+	if err != nil {
+		return durations
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ids[i] == current {
+			continue
+		}
+		s, err := ReadBuildStatus(workDir, ids[i])
+		if err != nil || s.DryRun {
+			continue
+		}
+		for _, script := range s.Scripts {
+			if _, ok := durations[script.Name]; !ok &&
+				script.Outcome == outcomeSucceeded {
+				durations[script.Name] = script.Duration
+			}
+		}
+	}
+	return durations
+}
+
+// processAlive reports whether a process exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// ListBuilds returns the IDs of the logged builds, oldest first.
+func ListBuilds(workDir string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(workDir, PATHNAME_LOG,
+		PATHNAME_BUILDS))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range files {
+		if fi.IsDir() && buildIDRe.MatchString(fi.Name()) {
+			ids = append(ids, fi.Name())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return buildIDLess(ids[i], ids[j])
+	})
+	return ids, nil
+}
+
+// buildIDLess reports whether build a started before build b. Builds started
+// in the same second are ordered by their numeric suffix.
+func buildIDLess(a, b string) bool {
+	if len(a) >= len(buildIDFormat) && len(b) >= len(buildIDFormat) &&
+		a[:len(buildIDFormat)] != b[:len(buildIDFormat)] {
+		return a < b
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// openLogFile opens a log file for appending.
+func openLogFile(pathname string) (*os.File, error) {
+	return os.OpenFile(pathname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// replaceSymlink atomically creates or replaces a symlink.
+func replaceSymlink(target, link string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// ScriptLogPath returns the path of the log file of a script.
+func (bl *BuildLog) ScriptLogPath(name string) string {
+	return filepath.Join(bl.dir, name+".log")
+}
+
+// StartScript opens the log file of a script, named after it, and adds it to
+// the loggers until the next script starts or the build log is closed.
+func (bl *BuildLog) StartScript(name string) error {
+	bl.EndScript()
+	f, err := openLogFile(bl.ScriptLogPath(name))
+	if err != nil {
+		return err
+	}
+	bl.script = f
+	AddLoggerOutput(f, LevelDebug)
+	Transcript.AddOutput(f, LevelDebug)
+	Std.SetScript(name)
+	Transcript.SetScript(name)
+
+	bl.status.Scripts = append(bl.status.Scripts, &ScriptStatus{
+		Name:    name,
+		Outcome: outcomeRunning,
+		Start:   time.Now(),
+	})
+	if err := bl.writeStatus(); err != nil {
+		Warningf("Writing build status: %s", err)
+	}
+	return nil
+}
+
+// EndScript closes the log file of the current script, if any.
+func (bl *BuildLog) EndScript() {
+	if bl.script == nil {
+		return
+	}
+	Std.RemoveOutput(bl.script)
+	Transcript.RemoveOutput(bl.script)
+	Std.SetScript("")
+	Transcript.SetScript("")
+	bl.script.Close()
+	bl.script = nil
+}
+
+// Close removes the build log files from the loggers, and closes them.
+func (bl *BuildLog) Close() {
+	bl.EndScript()
+	for _, f := range []*os.File{bl.text, bl.json} {
+		Std.RemoveOutput(f)
+		Transcript.RemoveOutput(f)
+		f.Close()
+	}
+}
+
+// PruneBuildLogs removes the log directories of old builds, keeping at most
+// keep builds, and none older than maxAge. A zero value disables the
+// respective limit. Dry runs are counted separately, so that they do not
+// push out the logs of real builds. The given current build is always kept.
+func PruneBuildLogs(workDir string, keep int, maxAge time.Duration,
+	current string) error {
+	buildsDir := filepath.Join(workDir, PATHNAME_LOG, PATHNAME_BUILDS)
+	files, err := ioutil.ReadDir(buildsDir)
+	if err != nil {
+		return err
+	}
+
+	// Newest first.
+	var builds []os.FileInfo
+	for _, fi := range files {
+		if fi.IsDir() && buildIDRe.MatchString(fi.Name()) {
+			builds = append(builds, fi)
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return buildIDLess(builds[j].Name(), builds[i].Name())
+	})
+
+	var kept, keptDry int
+	for _, fi := range builds {
+		count := &kept
+		if s, err := ReadBuildStatus(workDir, fi.Name()); err == nil &&
+			s.DryRun {
+			count = &keptDry
+		}
+		*count++
+		if fi.Name() == current {
+			continue
+		}
+		tooMany := keep > 0 && *count > keep
+		tooOld := maxAge > 0 && time.Since(fi.ModTime()) > maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		Debugf("Removing log of build %s.", fi.Name())
+		if err := os.RemoveAll(filepath.Join(buildsDir,
+			fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneBuildLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rib-buildlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buildsDir := filepath.Join(dir, PATHNAME_LOG, PATHNAME_BUILDS)
+	old := time.Now().Add(-48 * time.Hour)
+	builds := map[string]time.Time{
+		"20240101-000000":   old,
+		"20240102-000000":   old,
+		"20240103-000000":   time.Now(),
+		"20240103-000000.1": time.Now(),
+		"20240104-000000":   time.Now(),
+		"not-a-build":       old,
+	}
+	mkBuilds := func() {
+		for id, mtime := range builds {
+			pathname := filepath.Join(buildsDir, id)
+			if err := os.MkdirAll(pathname, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(pathname, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	remaining := func() string {
+		files, err := ioutil.ReadDir(buildsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	tests := []struct {
+		keep    int
+		maxAge  time.Duration
+		current string
+		want    string
+	}{
+		{0, 0, "", "20240101-000000 20240102-000000 20240103-000000 " +
+			"20240103-000000.1 20240104-000000 not-a-build"},
+		{2, 0, "", "20240103-000000.1 20240104-000000 not-a-build"},
+		{0, 24 * time.Hour, "", "20240103-000000 20240103-000000.1 " +
+			"20240104-000000 not-a-build"},
+		{1, 24 * time.Hour, "20240101-000000", "20240101-000000 " +
+			"20240104-000000 not-a-build"},
+	}
+	for _, test := range tests {
+		mkBuilds()
+		if err := PruneBuildLogs(dir, test.keep, test.maxAge,
+			test.current); err != nil {
+			t.Fatalf("PruneBuildLogs: %s", err)
+		}
+		if got := remaining(); got != test.want {
+			t.Errorf("PruneBuildLogs(%d, %s, %q): got %q, want %q",
+				test.keep, test.maxAge, test.current, got,
+				test.want)
+		}
+		os.RemoveAll(buildsDir)
+	}
+}
+
+func TestPruneBuildLogsDryRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rib-buildlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Dry runs do not count towards the real builds that are kept.
+	buildsDir := filepath.Join(dir, PATHNAME_LOG, PATHNAME_BUILDS)
+	for _, id := range []string{"20240101-000000", "20240102-000000",
+		"20240103-000000", "20240104-000000", "20240105-000000"} {
+		pathname := filepath.Join(buildsDir, id)
+		if err := os.MkdirAll(pathname, 0755); err != nil {
+			t.Fatal(err)
+		}
+		status := `{"id":"` + id + `"}`
+		if id > "20240102-000000" {
+			status = `{"id":"` + id + `","dry_run":true}`
+		}
+		if err := ioutil.WriteFile(filepath.Join(pathname,
+			PATHNAME_BUILDSTATUS), []byte(status), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PruneBuildLogs(dir, 2, 0, "20240105-000000"); err != nil {
+		t.Fatalf("PruneBuildLogs: %s", err)
+	}
+	files, err := ioutil.ReadDir(buildsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	want := "20240101-000000 20240102-000000 20240104-000000 " +
+		"20240105-000000"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("PruneBuildLogs: got %q, want %q", got, want)
+	}
+}
+
+func TestBuildIDLess(t *testing.T) {
+	ids := []string{"20240102-000000", "20240101-000000.10",
+		"20240101-000000", "20240101-000000.2", "20240101-120000"}
+	sort.Slice(ids, func(i, j int) bool {
+		return buildIDLess(ids[i], ids[j])
+	})
+	want := "20240101-000000 20240101-000000.2 20240101-000000.10 " +
+		"20240101-120000 20240102-000000"
+	if got := strings.Join(ids, " "); got != want {
+		t.Errorf("buildIDLess: got %q, want %q", got, want)
+	}
+}
+
+func TestOpenBuildLogFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rib-buildlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An old build.log that cannot be kept, as build.log.old is a
+	// non-empty directory.
+	logDir := filepath.Join(dir, PATHNAME_LOG)
+	old := filepath.Join(logDir, PATHNAME_BUILDLOG+".old")
+	if err := os.MkdirAll(filepath.Join(old, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(logDir, PATHNAME_BUILDLOG), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sinks := len(Std.sinks)
+	if _, err := OpenBuildLog(dir, time.Now()); err == nil {
+		t.Fatalf("OpenBuildLog did not fail.")
+	}
+	if len(Std.sinks) != sinks {
+		t.Fatalf("Failed OpenBuildLog left %d log sinks, want %d",
+			len(Std.sinks), sinks)
+	}
+}
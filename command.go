@@ -11,8 +11,12 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Command environment flags.
@@ -24,6 +28,13 @@ const (
 	Edirectexec
 	Eignoreexit
 	Eskip
+	Epty
+)
+
+// Default chroot settings.
+const (
+	defaultFakechrootEnv = "debootstrap"
+	defaultChrootPath    = "/usr/sbin:/usr/bin:/sbin:/bin"
 )
 
 // Commands available to child processes.
@@ -31,18 +42,44 @@ type ChildData struct {
 	category string
 	key      string
 	value    string
+	sep      string
 }
 
 // Command execution environment.
 type CmdEnv struct {
 	exec.Cmd
+	name             string
 	flag             int
 	workDir          string
 	chrootDir        string
 	fakerootSaveFile string
 	vTmpDir          string
 	vExecDir         string
-	childDataHandler func(*ChildData)
+	arch             string
+	dryRun           bool
+	fakechrootEnv    string
+	fakechrootConfig string
+	chrootPath       string
+	shares           []Share
+	companions       []string
+	ptyCols          int
+	ptyRows          int
+	hideInput        bool
+	answersFile      string
+	answers          []Answer
+	answerIdle       time.Duration
+	strictProtocol   bool
+	protocolErr      error
+	faked            *FakedSession
+	rlimits          map[string]string
+	usage            *ResourceUsage
+	childDataHandler func(*CmdEnv, *ChildData)
+	artifacts        []pendingArtifact
+	outputTail       *lineRing
+	tailLines        int
+	scripts          []string
+	origin           string
+	childDataMu      sync.Mutex
 }
 
 // MakeArgs prepares a command's path and argument vector based on the
@@ -66,7 +103,15 @@ func (ce *CmdEnv) MakeArgs() (err error) {
 		ce.Args = append([]string{ce.Path, ce.chrootDir}, ce.Args...)
 	}
 
-	if ce.flag&Efakeroot != 0 {
+	if ce.flag&Efakeroot != 0 && ce.faked != nil {
+		// Connect to the shared faked session.
+		wrapperArgs, err := ce.faked.WrapperArgs()
+		if err != nil {
+			return err
+		}
+		ce.Path = wrapperArgs[0]
+		ce.Args = append(wrapperArgs, ce.Args...)
+	} else if ce.flag&Efakeroot != 0 {
 		if ce.Path, err = exec.LookPath("fakeroot"); err != nil {
 			return err
 		}
@@ -87,17 +132,284 @@ func (ce *CmdEnv) MakeArgs() (err error) {
 		if ce.Path, err = exec.LookPath("fakechroot"); err != nil {
 			return err
 		}
-		ce.Args = append([]string{
-			ce.Path,
-			"--environment",
-			"debootstrap",
-			"--",
-		}, ce.Args...)
+		fakechrootArgs := []string{ce.Path}
+		if ce.fakechrootEnv != "none" {
+			fakechrootArgs = append(fakechrootArgs,
+				"--environment", ce.fakechrootEnv)
+		}
+		if ce.fakechrootConfig != "" {
+			configDir := ce.fakechrootConfig
+			if !filepath.IsAbs(configDir) {
+				configDir = filepath.Join(ce.workDir, configDir)
+			}
+			fakechrootArgs = append(fakechrootArgs,
+				"--config-dir", configDir)
+		}
+		ce.Args = append(append(fakechrootArgs, "--"), ce.Args...)
+	}
+
+	if len(ce.rlimits) > 0 {
+		limitPath, err := exec.LookPath("prlimit")
+		if err != nil {
+			return err
+		}
+		limitArgs := []string{limitPath}
+		for _, rd := range rlimitDirectives {
+			if value, ok := ce.rlimits[rd.option]; ok {
+				limitArgs = append(limitArgs, fmt.Sprintf(
+					"--%s=%s", rd.option, value))
+			}
+		}
+		ce.Path = limitPath
+		ce.Args = append(append(limitArgs, "--"), ce.Args...)
+	}
+
+	return nil
+}
+
+// ApplyDirectives configures the command environment according to the
+// directives found in the work directory configuration and script header.
+func (ce *CmdEnv) ApplyDirectives(d Directives) (err error) {
+	if ce.rlimits, err = parseRlimits(d); err != nil {
+		return err
+	}
+
+	ce.fakechrootEnv = defaultFakechrootEnv
+	if v, ok := d.Get("fakechroot-env"); ok && v != "" {
+		ce.fakechrootEnv = v
+	}
+	ce.fakechrootConfig, _ = d.Get("fakechroot-config-dir")
+	ce.chrootPath = defaultChrootPath
+	if v, ok := d.Get("chroot-path"); ok && v != "" {
+		ce.chrootPath = v
+	}
+	if ce.shares, err = parseShares(d); err != nil {
+		return err
+	}
+	if ce.companions, err = ce.parseCompanions(d); err != nil {
+		return err
+	}
+
+	pty, ok, err := d.GetBool("pty")
+	if err != nil {
+		return err
+	}
+	if ok && pty {
+		ce.flag |= Epty
+	} else if ok {
+		ce.flag &^= Epty
+	}
+	logInput, ok, err := d.GetBool("log-input")
+	if err != nil {
+		return err
+	}
+	if ok {
+		ce.hideInput = !logInput
+	}
+	if ce.strictProtocol, _, err = d.GetBool("strict-protocol"); err != nil {
+		return err
+	}
+	ce.ptyCols, ce.ptyRows = defaultPtyCols, defaultPtyRows
+	if v, ok := d.Get("pty-size"); ok {
+		if ce.ptyCols, ce.ptyRows, err = parsePtySize(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetAnswers reads the answer file used to run an interactive command
+// unattended.
+func (ce *CmdEnv) SetAnswers(pathname string) (err error) {
+	if ce.flag&Einteractive == 0 {
+		Warningf("Ignoring answer file for non-interactive '%s'.",
+			ce.name)
+		return nil
+	}
+	if ce.answers, ce.answerIdle, err = ReadAnswers(pathname); err != nil {
+		return err
+	}
+	ce.answersFile = pathname
+	return nil
+}
+
+// parseCompanions collects the files and directories to copy alongside the
+// script into the chroot: a sibling directory named after the script with a
+// ".d" suffix, if present, and any given by companion directives. Companion
+// paths are relative to the script directory, and may not leave it.
+func (ce *CmdEnv) parseCompanions(d Directives) ([]string, error) {
+	dir := filepath.Dir(ce.Path)
+	var companions []string
+	add := func(pathname string) {
+		for _, c := range companions {
+			if c == pathname {
+				return
+			}
+		}
+		companions = append(companions, pathname)
+	}
+
+	sibling := ce.Path + ".d"
+	if fi, err := os.Stat(sibling); err == nil && fi.IsDir() {
+		add(sibling)
+	}
+	for _, v := range d["companion"] {
+		if v == "none" {
+			companions = nil
+			continue
+		}
+		rel := filepath.Clean(v)
+		if filepath.IsAbs(rel) || rel == "." || rel == ".." ||
+			strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf(
+				"companion must be relative to the script "+
+					"directory: %q", v)
+		}
+		pathname := filepath.Join(dir, rel)
+		if _, err := os.Stat(pathname); err != nil {
+			return nil, err
+		}
+		add(pathname)
 	}
+	return companions, nil
+}
 
+// Settings lists the effective settings of the command environment, on the
+// form "key=value".
+func (ce *CmdEnv) Settings() []string {
+	var settings []string
+	if ce.flag&Efakechroot != 0 {
+		settings = append(settings,
+			"fakechroot-env="+ce.fakechrootEnv)
+		if ce.fakechrootConfig != "" {
+			settings = append(settings,
+				"fakechroot-config-dir="+ce.fakechrootConfig)
+		}
+	}
+	if ce.flag&Echroot != 0 {
+		settings = append(settings, "chroot-path="+ce.chrootPath)
+		for _, s := range ce.shares {
+			settings = append(settings, "share="+s.String())
+		}
+		for _, c := range ce.companions {
+			settings = append(settings, "companion="+
+				filepath.Base(c))
+		}
+	}
+	if ce.flag&Epty != 0 && ce.flag&Einteractive == 0 {
+		settings = append(settings, fmt.Sprintf("pty-size=%dx%d",
+			ce.ptyCols, ce.ptyRows))
+	}
+	if ce.flag&Einteractive != 0 && ce.hideInput {
+		settings = append(settings, "log-input=no")
+	}
+	if ce.flag&Einteractive != 0 && ce.answersFile != "" {
+		settings = append(settings, "answers="+ce.answersFile)
+	}
+	if ce.strictProtocol {
+		settings = append(settings, "strict-protocol=yes")
+	}
+	for _, rd := range rlimitDirectives {
+		if value, ok := ce.rlimits[rd.option]; ok {
+			settings = append(settings, rd.directive+"="+value)
+		}
+	}
+	return settings
+}
+
+// FlagString returns the execution flags of the command environment, as
+// given in a script filename.
+func (ce *CmdEnv) FlagString() string {
+	var flags []byte
+	for _, f := range []struct {
+		flag   int
+		letter byte
+	}{
+		{Einteractive, 'I'},
+		{Efakeroot, 'R'},
+		{Efakechroot, 'F'},
+		{Echroot, 'C'},
+		{Eignoreexit, 'E'},
+		{Eskip, 'S'},
+		{Epty, 'T'},
+	} {
+		if ce.flag&f.flag == 0 {
+			continue
+		}
+		// The chroot flag implies fakeroot and fakechroot.
+		if ce.flag&Echroot != 0 && (f.flag == Efakeroot ||
+			f.flag == Efakechroot) {
+			continue
+		}
+		flags = append(flags, f.letter)
+	}
+	return string(flags)
+}
+
+// DryRun prints the command that would be executed, along with its effective
+// settings and environment, without running it. Volatile directories are
+// shown as placeholders.
+func (ce *CmdEnv) DryRun() error {
+	if ce.flag&Echroot != 0 {
+		ce.vTmpDir = filepath.Join(ce.chrootDir, ".volatile.XXXXXX")
+		ce.vExecDir = filepath.Join(ce.chrootDir, ".exec.XXXXXX")
+		if ce.flag&Edirectexec == 0 {
+			ce.Path = filepath.Join("/",
+				filepath.Base(ce.vExecDir),
+				filepath.Base(ce.Path))
+		}
+	} else {
+		ce.vTmpDir = filepath.Join(ce.workDir, PATHNAME_TMP,
+			".volatile.XXXXXX")
+	}
+
+	fmt.Printf("%s [%s]\n", ce.name, ce.FlagString())
+	for _, setting := range ce.Settings() {
+		fmt.Printf("  %s\n", MaskSecrets(setting))
+	}
+
+	if err := ce.SetEnv(); err != nil {
+		fmt.Printf("  error: %s\n", err)
+		return err
+	}
+	// Show the effective environment, where the last value of a
+	// variable wins.
+	effective := make(map[string]string)
+	for _, e := range ce.Env {
+		effective[strings.SplitN(e, "=", 2)[0]] = e
+	}
+	var env []string
+	for _, e := range effective {
+		env = append(env, e)
+	}
+	sort.Strings(env)
+	for _, e := range env {
+		fmt.Printf("  env: %s\n", MaskSecrets(e))
+	}
+
+	if err := ce.MakeArgs(); err != nil {
+		fmt.Printf("  error: %s\n", err)
+		return err
+	}
+	fmt.Printf("  exec: %s\n", MaskSecrets(strings.Join(ce.Args, " ")))
 	return nil
 }
 
+// recordUsage saves the resource usage of the finished command.
+func (ce *CmdEnv) recordUsage() {
+	if ce.ProcessState == nil {
+		return
+	}
+	ru, ok := ce.ProcessState.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return
+	}
+	usage := NewResourceUsage(ru)
+	ce.usage = &usage
+	Infof("Resource usage for '%s': %s", ce.name, usage)
+}
+
 // MakeVolatileDirs creates volatile directories for a command's execution
 // environment.
 func (ce *CmdEnv) MakeVolatileDirs() (err error) {
@@ -137,8 +449,11 @@ func (ce *CmdEnv) RemoveVolatileDirs() {
 		ce.vTmpDir,
 		ce.vExecDir,
 	} {
-		if dir != "" {
-			os.RemoveAll(dir)
+		if dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			Errorf("Removing volatile directory '%s': %s", dir, err)
 		}
 	}
 }
@@ -149,7 +464,7 @@ func (ce *CmdEnv) SetEnv() (err error) {
 	// Configure the volatile command environment.
 	cmdVolatileEnv := make(map[string]string)
 	if ce.flag&Echroot != 0 {
-		cmdVolatileEnv["PATH"] = "/usr/sbin:/usr/bin:/sbin:/bin"
+		cmdVolatileEnv["PATH"] = ce.chrootPath
 		vTmpChrootDir, err := filepath.Rel(
 			filepath.Join(ce.workDir, PATHNAME_ROOTFS),
 			ce.vTmpDir)
@@ -159,6 +474,13 @@ func (ce *CmdEnv) SetEnv() (err error) {
 		}
 		cmdVolatileEnv["VTEMP"] = filepath.Join(
 			"/", vTmpChrootDir)
+
+		// Env vars for rib directories shared into the chroot.
+		for _, s := range ce.shares {
+			if s.envvar != "" {
+				cmdVolatileEnv[s.envvar] = s.target
+			}
+		}
 	} else {
 		cmdVolatileEnv["PATH"] = fmt.Sprintf("%s:%s",
 			filepath.Join(ce.workDir, PATHNAME_BIN),
@@ -174,6 +496,15 @@ func (ce *CmdEnv) SetEnv() (err error) {
 		}
 	}
 
+	// Make "rib ctl" available to the command.
+	ctlPath, err := ce.ctlPath()
+	if err != nil {
+		Errorf("ctlPath: %s", err)
+		return err
+	}
+	cmdVolatileEnv["RIB"] = ctlPath
+	cmdVolatileEnv["PATH"] += ":" + filepath.Dir(ctlPath)
+
 	// Copy volatile environment to ce.Env string slice.
 	for name, value := range cmdVolatileEnv {
 		ce.Env = append(ce.Env,
@@ -186,16 +517,38 @@ func (ce *CmdEnv) SetEnv() (err error) {
 			fmt.Sprintf("%s=%s", name, value))
 	}
 
+	// Apply persistent list edits on top of the values above.
+	for name, l := range cmdPersistLists {
+		base, ok := cmdPersistEnv[name]
+		if !ok {
+			base = cmdVolatileEnv[name]
+		}
+		ce.Env = append(ce.Env,
+			fmt.Sprintf("%s=%s", name, l.Apply(base)))
+	}
+
+	// Export the target architecture.
+	if ce.arch != "" {
+		ce.Env = append(ce.Env, "RIB_ARCH="+ce.arch)
+	}
+
+	// Advertise the JSON control channel.
+	ce.Env = append(ce.Env, fmt.Sprintf("RIB_CONTROL_FD=%d", controlFd))
+
 	// Always set RIB_EXEC_ENV=1.
 	ce.Env = append(ce.Env, "RIB_EXEC_ENV=1")
 
+	for _, e := range ce.Env {
+		Tracef("Environment of '%s': %s", ce.name, e)
+	}
 	return nil
 }
 
-// readBuf scans line-based input and sends it to the Debugf logging function.
-func readBuf(s *bufio.Scanner, prefix string, stop chan bool) {
+// readBuf scans line-based input and sends it to the given logging function.
+func readBuf(s *bufio.Scanner, prefix string,
+	logf func(format string, v ...interface{}), stop chan bool) {
 	for s.Scan() {
-		Debugf("%s %s", prefix, s.Bytes())
+		logf("%s %s", prefix, s.Bytes())
 	}
 	stop <- true
 	if err := s.Err(); err != nil {
@@ -203,6 +556,16 @@ func readBuf(s *bufio.Scanner, prefix string, stop chan bool) {
 	}
 }
 
+// closeFiles closes the given files, returning the first error.
+func closeFiles(files []*os.File) (err error) {
+	for _, f := range files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // scanNull is a split function that returns null-delimited items. It is
 // a simple adaption of https://golang.org/pkg/bufio/#ScanLines
 func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -221,42 +584,66 @@ func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
-// readPipe scans input and hands it over to the childDataHandler function
-// specified in the command environment.
-func readPipe(s *bufio.Scanner, ce *CmdEnv, stop chan bool) {
-	for s.Scan() {
-		r := bytes.SplitN(s.Bytes(), []byte{'\x1f'}, 3)
-		ce.childDataHandler(&ChildData{
-			category: string(r[0]),
-			key:      string(r[1]),
-			value:    string(r[2]),
-		})
-	}
-	stop <- true
-	if err := s.Err(); err != nil {
-		Errorf("scan error: %s", err)
-	}
-}
-
 // RunCmd executes the command according to its environment. An interactive
 // command will run with stdin/out/err connected to the current terminal;
 // a non-interactive command will have its stdout/err captured and logged.
-func (ce *CmdEnv) RunCmd() error {
-	var err error
-
+func (ce *CmdEnv) RunCmd() (err error) {
 	// Set chroot directory.
 	ce.chrootDir = filepath.Join(ce.workDir, PATHNAME_ROOTFS)
 
 	// Set fakeroot save file path.
 	ce.fakerootSaveFile = filepath.Join(ce.workDir, PATHNAME_FAKEROOTSAVE)
 
+	if ce.dryRun {
+		return ce.DryRun()
+	}
+
+	// Keep the last lines of output, to show on failure.
+	if ce.tailLines == 0 {
+		ce.tailLines = defaultTailLines
+	}
+	ce.outputTail = newLineRing(ce.tailLines)
+
+	if settings := ce.Settings(); len(settings) > 0 {
+		Infof("Settings for '%s': %s", ce.name,
+			strings.Join(settings, " "))
+	}
+
 	// Set up volatile directories.
 	if err := ce.MakeVolatileDirs(); err != nil {
 		return err
 	}
 	defer ce.RemoveVolatileDirs()
 
+	// Set up emulation for foreign architecture chroots.
+	if ce.flag&Echroot != 0 {
+		cleanup, err := ce.SetupEmulation()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		// Copy shared host directories into the chroot.
+		teardown, err := ce.SetupShares()
+		if err != nil {
+			Errorf("SetupShares: %s", err)
+			return err
+		}
+		defer func() {
+			if terr := teardown(); terr != nil && err == nil {
+				err = terr
+			}
+		}()
+	}
+
 	if ce.flag&Echroot != 0 && ce.flag&Edirectexec == 0 {
+		// Make sure the script can be executed inside the chroot.
+		if err := CheckInterpreter(ce.chrootDir, ce.Path,
+			ce.chrootPath); err != nil {
+			Errorf("CheckInterpreter: %s", err)
+			return err
+		}
+
 		// Copy program to in-chroot, temporary execution dir.
 		Debugf("Copying '%s' to '%s'.", ce.Path, ce.vExecDir)
 		if err := CopyFile(ce.vExecDir, ce.Path); err != nil {
@@ -264,12 +651,30 @@ func (ce *CmdEnv) RunCmd() error {
 			return err
 		}
 
+		// Copy companion files and directories next to it.
+		for _, c := range ce.companions {
+			Debugf("Copying companion '%s' to '%s'.", c, ce.vExecDir)
+			if err := copyTree(filepath.Join(ce.vExecDir,
+				filepath.Base(c)), c); err != nil {
+				Errorf("copyTree: %s", err)
+				return err
+			}
+		}
+
 		// Modify Path to be relative to the chroot dir.
 		ce.Path = filepath.Join("/",
 			filepath.Base(ce.vExecDir),
 			filepath.Base(ce.Path))
 	}
 
+	// Copy the rib binary into the chroot, for "rib ctl".
+	if ce.flag&Echroot != 0 {
+		if err := ce.InstallCtl(); err != nil {
+			Errorf("InstallCtl: %s", err)
+			return err
+		}
+	}
+
 	// Set up command environment.
 	if err := ce.SetEnv(); err != nil {
 		return err
@@ -280,24 +685,41 @@ func (ce *CmdEnv) RunCmd() error {
 		return err
 	}
 
-	// Configure IO pipe, which the child can use to write data
-	// back to the main process.
+	// Configure IO pipes, which the child can use to write data
+	// back to the main process: fd 3 for records, and fd 4 for the
+	// JSON control channel.
 	pipeReadFile, pipeWriteFile, err := os.Pipe()
 	if err != nil {
 		Errorf("os.Pipe: %s", err)
 		return err
 	}
 	defer pipeReadFile.Close()
-	pipeScanner := bufio.NewScanner(pipeReadFile)
-	pipeScanner.Split(scanNull)
+	defer pipeWriteFile.Close()
+	controlReadFile, controlWriteFile, err := os.Pipe()
+	if err != nil {
+		Errorf("os.Pipe: %s", err)
+		return err
+	}
+	defer controlReadFile.Close()
+	defer controlWriteFile.Close()
 	stopPipe := make(chan bool)
-	go readPipe(pipeScanner, ce, stopPipe)
-	ce.ExtraFiles = []*os.File{pipeWriteFile}
+	go readPipe(pipeReadFile, controlReadFile, ce, stopPipe)
+	ce.ExtraFiles = []*os.File{pipeWriteFile, controlWriteFile}
 
 	Infof("Executing command: %s %s",
 		ce.Path, strings.Join(ce.Args[1:], " "))
 
-	if ce.flag&Einteractive != 0 {
+	// Interactive commands run on a pseudo-terminal, either answered
+	// from an answer file, or proxied to the user's terminal so that
+	// the session can be logged.
+	answered := ce.flag&Einteractive != 0 && ce.answersFile != ""
+	proxied := ce.flag&Einteractive != 0 && !answered &&
+		IsTerminal(os.Stdin)
+	if ce.flag&Einteractive != 0 && !answered && !proxied {
+		Warningf("Not a terminal; output of '%s' is not logged.", ce.name)
+	}
+
+	if ce.flag&Einteractive != 0 && !answered && !proxied {
 		ce.Stdin = os.Stdin
 		ce.Stdout = os.Stdout
 		ce.Stderr = os.Stderr
@@ -308,15 +730,88 @@ func (ce *CmdEnv) RunCmd() error {
 			return err
 		}
 
-		// Close our copy of the pipe's write end, to make our
-		// scanner's read call return EOF. Ref pipe(7).
-		if err := pipeWriteFile.Close(); err != nil {
+		// Close our copy of the pipes' write ends, to make our
+		// scanners' read calls return EOF. Ref pipe(7).
+		if err := closeFiles(ce.ExtraFiles); err != nil {
 			Errorf("Close: %s", err)
 			return err
 		}
 
 		<-stopPipe
 		err = ce.Wait()
+	} else if answered || proxied || ce.flag&Epty != 0 {
+		// Attach the command to a pseudo-terminal, as its
+		// controlling terminal.
+		var ptyMaster, ptySlave *os.File
+		ptyMaster, ptySlave, err = OpenPty()
+		if err != nil {
+			Errorf("OpenPty: %s", err)
+			return err
+		}
+		defer ptyMaster.Close()
+		if err := SetPtySize(ptyMaster, ce.ptyCols, ce.ptyRows); err != nil {
+			ptySlave.Close()
+			Errorf("SetPtySize: %s", err)
+			return err
+		}
+		ce.Stdin = ptySlave
+		ce.Stdout = ptySlave
+		ce.Stderr = ptySlave
+		ce.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+		}
+
+		err = ce.Start()
+		// Close our copy of the slave end, to make reads from the
+		// master fail once the command and its children are done.
+		ptySlave.Close()
+		if err != nil {
+			Errorf("ce.Start: %s", err)
+			return err
+		}
+
+		stopPty := make(chan bool)
+		var answerErr error
+		if answered {
+			go func() {
+				kill := func() {
+					// Kill the whole session.
+					syscall.Kill(-ce.Process.Pid, syscall.SIGKILL)
+				}
+				if err := answerPty(ptyMaster, ce.answers,
+					ce.answerIdle, ce.logOutput,
+					kill); err != nil {
+					answerErr = err
+				}
+				stopPty <- true
+			}()
+		} else if proxied {
+			go func() {
+				if err := proxyPty(ptyMaster, ce.hideInput); err != nil {
+					Errorf("proxyPty: %s", err)
+					readPty(ptyMaster, "[tty]",
+						ce.logOutput, stopPty)
+					return
+				}
+				stopPty <- true
+			}()
+		} else {
+			go readPty(ptyMaster, "[pty]", ce.logOutput, stopPty)
+		}
+
+		// Close our copy of the pipes' write ends to make our
+		// scanners' read calls return EOF, ref pipe(7).
+		if err := closeFiles(ce.ExtraFiles); err != nil {
+			Errorf("Close: %s", err)
+		}
+
+		<-stopPty
+		<-stopPipe
+		err = ce.Wait()
+		if answerErr != nil {
+			err = answerErr
+		}
 	} else {
 		// Capture stdout and stderr.
 		var cmdStdoutReader, cmdStderrReader io.ReadCloser
@@ -340,15 +835,15 @@ func (ce *CmdEnv) RunCmd() error {
 
 		stdoutScanner := bufio.NewScanner(cmdStdoutReader)
 		stopStdout := make(chan bool)
-		go readBuf(stdoutScanner, "[stdout]", stopStdout)
+		go readBuf(stdoutScanner, "[stdout]", ce.logOutput, stopStdout)
 
 		stderrScanner := bufio.NewScanner(cmdStderrReader)
 		stopStderr := make(chan bool)
-		go readBuf(stderrScanner, "[stderr]", stopStderr)
+		go readBuf(stderrScanner, "[stderr]", ce.logOutput, stopStderr)
 
-		// Close our copy of the pipe's write end to make our
-		// scanner's read call return EOF, ref pipe(7).
-		if err := pipeWriteFile.Close(); err != nil {
+		// Close our copy of the pipes' write ends to make our
+		// scanners' read calls return EOF, ref pipe(7).
+		if err := closeFiles(ce.ExtraFiles); err != nil {
 			Errorf("Close: %s", err)
 		}
 
@@ -357,11 +852,15 @@ func (ce *CmdEnv) RunCmd() error {
 		<-stopPipe
 		err = ce.Wait()
 	}
+	ce.recordUsage()
 
 	if err != nil && ce.flag&Eignoreexit != 0 {
 		Warningf("Ignoring '%s' error: %s", ce.Path, err)
 		err = nil
 	}
+	if err == nil && ce.protocolErr != nil {
+		err = ce.protocolErr
+	}
 	return err
 }
 
@@ -369,31 +868,31 @@ func (ce *CmdEnv) RunCmd() error {
 // found in the given directory. Each script's sequence number must be equal to
 // or greater than the given seqmin value. Flags are parsed from the script
 // filename, and decide how the command environment struct is configured.
-func PrepareParts(dir string, seqmin int) (celist []*CmdEnv, err error) {
+// Header directives in each script are merged with the given configuration.
+func PrepareParts(dir string, seqmin int, config Directives) (celist []*CmdEnv, err error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	// Match filenames containing a sequence number and a list of
-	// execution flags, followed by an arbitrary name.
-	re := regexp.MustCompile(`^(\d+)-([A-Z]*)-`)
 	for _, file := range files {
-		ce := &CmdEnv{}
+		ce := &CmdEnv{name: file.Name()}
 		ce.Path = filepath.Join(dir, file.Name())
 		ce.Args = []string{ce.Path}
 
-		groups := re.FindStringSubmatch(file.Name())
-		if len(groups) != 3 {
-			Warningf("Skipping file '%s': regex mismatch",
-				file.Name())
+		// Directories hold companion files of a script.
+		if file.IsDir() {
+			Debugf("Skipping directory '%s'.", file.Name())
+			continue
+		}
+		if strings.HasSuffix(file.Name(), answersSuffix) {
+			Debugf("Skipping answer file '%s'.", file.Name())
 			continue
 		}
 
-		// Parse sequence number and compare to seqmin.
-		seq, err := strconv.Atoi(groups[1])
+		seq, flag, err := parseScriptName(file.Name())
 		if err != nil {
-			Errorf("strconv.Atoi: %s", err)
+			Warningf("Skipping file '%s': %s", file.Name(), err)
 			continue
 		}
 		if seq < seqmin {
@@ -401,36 +900,92 @@ func PrepareParts(dir string, seqmin int) (celist []*CmdEnv, err error) {
 				file.Name(), seq, seqmin)
 			continue
 		}
-
-		// Parse execution flags.
-		for _, flag := range groups[2] {
-			switch {
-			case flag == 'I':
-				ce.flag |= Einteractive
-			case flag == 'R':
-				ce.flag |= Efakeroot
-			case flag == 'F':
-				ce.flag |= Efakechroot
-			case flag == 'C':
-				ce.flag |= Echroot
-				ce.flag |= Efakeroot
-				ce.flag |= Efakechroot
-			case flag == 'E':
-				ce.flag |= Eignoreexit
-			case flag == 'S':
-				ce.flag |= Eskip
-			default:
-				Warningf("Ignoring unknown flag %q.", flag)
-			}
-		}
+		ce.flag = flag
 
 		if ce.flag&Eskip != 0 {
 			continue
 		}
 
+		if err := ce.prepareScript(config); err != nil {
+			return nil, err
+		}
+
 		Debugf("Registering build command: %s", ce.Path)
 		celist = append(celist, ce)
 	}
 
 	return celist, nil
 }
+
+// Match script names containing a sequence number and a list of execution
+// flags, followed by an arbitrary name.
+var scriptNameRe = regexp.MustCompile(`^(\d+)-([A-Z]*)-`)
+
+// parseScriptName parses the sequence number and execution flags of a script
+// name.
+func parseScriptName(name string) (seq int, flag int, err error) {
+	groups := scriptNameRe.FindStringSubmatch(name)
+	if len(groups) != 3 {
+		return 0, 0, errors.New("regex mismatch")
+	}
+
+	// Parse sequence number.
+	seq, err = strconv.Atoi(groups[1])
+	if err != nil {
+		Errorf("strconv.Atoi: %s", err)
+		return 0, 0, err
+	}
+
+	// Parse execution flags.
+	for _, f := range groups[2] {
+		switch {
+		case f == 'I':
+			flag |= Einteractive
+		case f == 'R':
+			flag |= Efakeroot
+		case f == 'F':
+			flag |= Efakechroot
+		case f == 'C':
+			flag |= Echroot
+			flag |= Efakeroot
+			flag |= Efakechroot
+		case f == 'E':
+			flag |= Eignoreexit
+		case f == 'S':
+			flag |= Eskip
+		case f == 'T':
+			flag |= Epty
+		default:
+			Warningf("Ignoring unknown flag %q.", f)
+		}
+	}
+	return seq, flag, nil
+}
+
+// prepareScript applies the header directives of the script, merged with the
+// given configuration, and an answer file next to the script.
+func (ce *CmdEnv) prepareScript(config Directives) error {
+	// Parse header directives.
+	d, err := ReadScriptHeader(ce.Path)
+	if err != nil {
+		Errorf("ReadScriptHeader(%s): %s", ce.Path, err)
+		return err
+	}
+	if err := ce.ApplyDirectives(config.Merge(d)); err != nil {
+		Errorf("Invalid header in '%s': %s", ce.name, err)
+		return err
+	}
+	if err := ce.DropUnusedShares(); err != nil {
+		Errorf("DropUnusedShares: %s", err)
+		return err
+	}
+
+	// Use an answer file next to the script.
+	if _, err := os.Stat(ce.Path + answersSuffix); err == nil {
+		if err := ce.SetAnswers(ce.Path + answersSuffix); err != nil {
+			Errorf("SetAnswers: %s", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Directory holding the rib binary inside the in-chroot execution dir, and
+// the binary name used there.
+const (
+	ctlBinDir  = ".bin"
+	ctlBinName = "rib"
+)
+
+// Log levels accepted from scripts.
+var ctlLogLevels = map[string]func(format string, v ...interface{}){
+	"debug": Debugf,
+	"info":  Infof,
+	"warn":  Warningf,
+	"error": Errorf,
+}
+
+// cmdCtl sends a message on the JSON control channel of the rib process
+// running the calling build script. The separator is only used for list
+// updates.
+func cmdCtl(category, key, value, sep string) error {
+	s := os.Getenv("RIB_CONTROL_FD")
+	if s == "" {
+		return errors.New("RIB_CONTROL_FD is not set; not running " +
+			"under rib")
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil || fd < 0 {
+		return fmt.Errorf("invalid RIB_CONTROL_FD %q", s)
+	}
+
+	// Catch mistakes here, rather than as protocol errors.
+	if err := validateChildData(&ChildData{
+		category: category,
+		key:      key,
+		value:    value,
+	}); err != nil {
+		return err
+	}
+
+	msg, err := json.Marshal(controlMessage{
+		Version: controlVersion,
+		Type:    category,
+		Key:     key,
+		Value:   value,
+		Sep:     sep,
+	})
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "control")
+	if f == nil {
+		return fmt.Errorf("invalid RIB_CONTROL_FD %q", s)
+	}
+	_, err = f.Write(append(msg, '\n'))
+	return err
+}
+
+// Warn only once about a dynamically linked rib binary.
+var ctlStaticOnce sync.Once
+
+// ctlExecutable returns the path of the running rib binary.
+func ctlExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// ctlPath returns the path of the rib binary as seen by the command.
+func (ce *CmdEnv) ctlPath() (string, error) {
+	if ce.flag&Echroot != 0 {
+		return filepath.Join("/", filepath.Base(ce.vExecDir),
+			ctlBinDir, ctlBinName), nil
+	}
+	return ctlExecutable()
+}
+
+// InstallCtl copies the rib binary into the in-chroot execution directory,
+// so that scripts can use "rib ctl". A dynamically linked binary may not run
+// there, so it is skipped with a warning.
+func (ce *CmdEnv) InstallCtl() error {
+	exe, err := ctlExecutable()
+	if err != nil {
+		return err
+	}
+	if !isStaticELF(exe) {
+		ctlStaticOnce.Do(func() {
+			Warningf("The rib binary is not statically linked; " +
+				"'rib ctl' is not available inside the chroot. " +
+				"Build with CGO_ENABLED=0 to avoid this.")
+		})
+		return nil
+	}
+
+	dir := filepath.Join(ce.vExecDir, ctlBinDir)
+	if err := EnsureDir(dir); err != nil {
+		return err
+	}
+	return copyTree(filepath.Join(dir, ctlBinName), exe)
+}
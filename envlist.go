@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Map of list edits applied to the environment of all commands, on top of
+// the volatile and persistent values.
+var cmdPersistLists map[string]*envList
+
+// An envList holds the elements appended and prepended to a list-valued
+// environment variable, like PATH or a space-separated list of packages.
+// Path lists, separated by ':', are de-duplicated.
+type envList struct {
+	sep     string
+	prepend []string
+	append  []string
+}
+
+// defaultEnvSep returns the list separator used for a variable unless one is
+// given: ':' for PATH-like variables, and a space otherwise.
+func defaultEnvSep(key string) string {
+	if strings.HasSuffix(key, "PATH") {
+		return ":"
+	}
+	return " "
+}
+
+// persistList returns the list edits of the variable, creating them if
+// needed.
+func persistList(key string) *envList {
+	l, ok := cmdPersistLists[key]
+	if !ok {
+		l = &envList{sep: defaultEnvSep(key)}
+		cmdPersistLists[key] = l
+	}
+	return l
+}
+
+// SetSep sets the list separator. It cannot change once elements have been
+// added, since they were split with the old separator.
+func (l *envList) SetSep(sep string) error {
+	if sep != l.sep && len(l.prepend)+len(l.append) > 0 {
+		return fmt.Errorf("cannot change the separator from %q to %q "+
+			"after elements have been added", l.sep, sep)
+	}
+	l.sep = sep
+	return nil
+}
+
+// split splits a value into its non-empty list elements.
+func (l *envList) split(value string) []string {
+	var elems []string
+	for _, e := range strings.Split(value, l.sep) {
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// Append adds the elements of the value to the end of the list.
+func (l *envList) Append(value string) {
+	l.append = append(l.append, l.split(value)...)
+}
+
+// Prepend adds the elements of the value to the front of the list, before
+// any earlier prepended elements.
+func (l *envList) Prepend(value string) {
+	l.prepend = append(l.split(value), l.prepend...)
+}
+
+// Apply returns the list built from the given base value. Path lists keep
+// only the first occurrence of each element, so that prepended elements take
+// precedence.
+func (l *envList) Apply(base string) string {
+	var elems []string
+	elems = append(elems, l.prepend...)
+	elems = append(elems, l.split(base)...)
+	elems = append(elems, l.append...)
+
+	if l.sep == ":" {
+		seen := make(map[string]bool)
+		unique := elems[:0]
+		for _, e := range elems {
+			if !seen[e] {
+				seen[e] = true
+				unique = append(unique, e)
+			}
+		}
+		elems = unique
+	}
+	return strings.Join(elems, l.sep)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEnvList(t *testing.T) {
+	l := &envList{sep: defaultEnvSep("PATH")}
+	l.Append("/opt/bin")
+	l.Prepend("/usr/local/bin")
+	l.Prepend("/home/bin:/usr/bin")
+	l.Append("/opt/bin:/sbin")
+	want := "/home/bin:/usr/bin:/usr/local/bin:/bin:/opt/bin:/sbin"
+	if got := l.Apply("/usr/bin:/bin"); got != want {
+		t.Fatalf("Apply: got %q, want %q", got, want)
+	}
+
+	l = &envList{sep: defaultEnvSep("EXTRA_PACKAGES")}
+	l.Append("vim")
+	l.Append("less  vim")
+	want = "curl vim less vim"
+	if got := l.Apply("curl"); got != want {
+		t.Fatalf("Apply: got %q, want %q", got, want)
+	}
+	if got := l.Apply(""); got != "vim less vim" {
+		t.Fatalf("Apply: got %q, want %q", got, "vim less vim")
+	}
+
+	l = &envList{sep: ","}
+	l.Prepend("console=ttyS0")
+	if got := l.Apply("quiet"); got != "console=ttyS0,quiet" {
+		t.Fatalf("Apply: got %q, want %q", got, "console=ttyS0,quiet")
+	}
+}
+
+func TestEnvListSetSep(t *testing.T) {
+	l := &envList{sep: defaultEnvSep("KERNEL_ARGS")}
+	if err := l.SetSep(","); err != nil {
+		t.Fatalf("SetSep on an empty list failed: %s", err)
+	}
+	l.Append("console=ttyS0,quiet")
+	if err := l.SetSep(","); err != nil {
+		t.Fatalf("SetSep to the same separator failed: %s", err)
+	}
+	if err := l.SetSep(" "); err == nil {
+		t.Fatalf("SetSep changed the separator of a non-empty list.")
+	}
+	if got := l.Apply(""); got != "console=ttyS0,quiet" {
+		t.Fatalf("Apply: got %q, want %q", got, "console=ttyS0,quiet")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Version of the facts file format.
+const factsVersion = 1
+
+// Valid fact names, like "kernel.version" or "debian-release".
+var factKeyRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Facts recorded by the commands of the current build.
+var buildFacts *Facts
+
+// A Fact is a value recorded by a build script, along with the name of the
+// script.
+type Fact struct {
+	Value  string `json:"value"`
+	Script string `json:"script"`
+}
+
+// Facts holds the facts of a work directory. They describe the rootfs, and
+// are kept across builds until replaced or cleaned.
+type Facts struct {
+	Version int              `json:"version"`
+	Facts   map[string]*Fact `json:"facts"`
+
+	dirty bool
+}
+
+// ReadFacts reads the facts file of the work directory. A missing file yields
+// no facts.
+func ReadFacts(workDir string) (*Facts, error) {
+	f := &Facts{Version: factsVersion}
+	data, err := ioutil.ReadFile(filepath.Join(workDir, PATHNAME_FACTS))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, f); err != nil {
+			return nil, fmt.Errorf("%s: %s", PATHNAME_FACTS, err)
+		}
+	}
+	if f.Facts == nil {
+		f.Facts = make(map[string]*Fact)
+	}
+	return f, nil
+}
+
+// Set records a fact, replacing any earlier value. Secret values are masked,
+// so that they are never written to disk.
+func (f *Facts) Set(key, value, script string) {
+	f.Facts[key] = &Fact{Value: MaskSecrets(value), Script: script}
+	f.dirty = true
+}
+
+// Keys returns the sorted fact names.
+func (f *Facts) Keys() []string {
+	var keys []string
+	for key := range f.Facts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write saves the facts in the work directory, if they have changed.
+func (f *Facts) Write(workDir string) error {
+	if !f.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	pathname := filepath.Join(workDir, PATHNAME_FACTS)
+	tmp := pathname + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, pathname); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// cmdFacts prints the value of a fact, or all facts as "key=value" lines.
+func cmdFacts(workDir, key string) error {
+	workDir, err := RealPath(workDir)
+	if err != nil {
+		Errorf("RealPath: %s", err)
+		return err
+	}
+
+	if !isRibDir(workDir) {
+		Errorf("No rib structure found in '%s'.", workDir)
+		return errors.New("invalid directory")
+	}
+
+	facts, err := ReadFacts(workDir)
+	if err != nil {
+		Errorf("ReadFacts: %s", err)
+		return err
+	}
+
+	if key != "" {
+		fact, ok := facts.Facts[key]
+		if !ok {
+			return fmt.Errorf("no fact '%s'", key)
+		}
+		fmt.Println(fact.Value)
+		return nil
+	}
+	for _, key := range facts.Keys() {
+		fmt.Printf("%s=%s\n", key, facts.Facts[key].Value)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rib-facts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := ReadFacts(dir)
+	if err != nil {
+		t.Fatalf("ReadFacts: %s", err)
+	}
+	if len(f.Facts) != 0 {
+		t.Fatalf("ReadFacts: got %d facts, want 0", len(f.Facts))
+	}
+
+	defer resetSecrets()
+	AddSecret("s3cr3t-fact")
+	f.Set("kernel.version", "6.1.0-13-amd64", "10-C-kernel")
+	f.Set("token", "s3cr3t-fact", "20--token")
+	f.Set("kernel.version", "6.1.0-18-amd64", "30-C-upgrade")
+	if err := f.Write(dir); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	f, err = ReadFacts(dir)
+	if err != nil {
+		t.Fatalf("ReadFacts: %s", err)
+	}
+	want := map[string]Fact{
+		"kernel.version": {"6.1.0-18-amd64", "30-C-upgrade"},
+		"token":          {secretMask, "20--token"},
+	}
+	if len(f.Facts) != len(want) {
+		t.Fatalf("ReadFacts: got %d facts, want %d", len(f.Facts),
+			len(want))
+	}
+	for key, w := range want {
+		if got := f.Facts[key]; got == nil || *got != w {
+			t.Errorf("fact %q: got %+v, want %+v", key, got, w)
+		}
+	}
+}
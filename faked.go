@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// Default fakeroot preload library and faked daemon, used if they cannot be
+// determined from the fakeroot script.
+const (
+	fakerootDefaultLib   = "libfakeroot-sysv.so"
+	fakerootDefaultFaked = "faked-sysv"
+)
+
+// A FakedSession is a faked(1) daemon shared by all fakeroot-wrapped commands
+// in a build. Commands connect to it through FAKEROOTKEY, instead of starting
+// a new daemon that loads and saves the entire fakeroot save file.
+type FakedSession struct {
+	cmd      *exec.Cmd
+	key      string
+	saveFile string
+	lib      string
+	libPaths string
+}
+
+// fakerootSettings extracts the preload library, its search path and the
+// faked daemon path from the fakeroot shell script, which is where a
+// distribution configures them.
+func fakerootSettings() (lib, libPaths, faked string, err error) {
+	script, err := exec.LookPath("fakeroot")
+	if err != nil {
+		return "", "", "", err
+	}
+	f, err := os.Open(script)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer f.Close()
+
+	// Only the first assignment of each variable holds the default.
+	re := regexp.MustCompile(
+		`^(FAKEROOT_PREFIX|FAKEROOT_BINDIR|FAKEROOT_LIB|PATHS|FAKED)=(.*)$`)
+	vars := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		groups := re.FindStringSubmatch(strings.TrimSpace(s.Text()))
+		if len(groups) != 3 {
+			continue
+		}
+		if _, ok := vars[groups[1]]; ok {
+			continue
+		}
+		vars[groups[1]] = os.Expand(strings.Trim(groups[2], `"'`),
+			func(name string) string { return vars[name] })
+	}
+	if err := s.Err(); err != nil && err != bufio.ErrTooLong {
+		return "", "", "", err
+	}
+
+	lib = vars["FAKEROOT_LIB"]
+	if lib == "" {
+		lib = fakerootDefaultLib
+	}
+	libPaths = vars["PATHS"]
+	faked = vars["FAKED"]
+	if faked == "" {
+		faked = fakerootDefaultFaked
+	}
+	if faked, err = exec.LookPath(faked); err != nil {
+		return "", "", "", err
+	}
+
+	// Verify that the preload library is available.
+	for _, dir := range filepath.SplitList(libPaths) {
+		if _, err := os.Stat(filepath.Join(dir, lib)); err == nil {
+			return lib, libPaths, faked, nil
+		}
+	}
+	if filepath.IsAbs(lib) {
+		if _, err := os.Stat(lib); err == nil {
+			return lib, libPaths, faked, nil
+		}
+	}
+	return "", "", "", fmt.Errorf("preload library '%s' not found", lib)
+}
+
+// StartFakedSession starts a faked daemon that loads its state from, and
+// saves it to, the given fakeroot save file.
+func StartFakedSession(saveFile string) (*FakedSession, error) {
+	lib, libPaths, faked, err := fakerootSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FakedSession{
+		saveFile: saveFile,
+		lib:      lib,
+		libPaths: libPaths,
+	}
+	fs.cmd = exec.Command(faked, "--foreground",
+		"--save-file", saveFile, "--load")
+	in, err := os.Open(saveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	fs.cmd.Stdin = in
+	out, err := fs.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// The daemon announces itself with a "key:pid" line.
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		fs.cmd.Process.Kill()
+		fs.cmd.Wait()
+		return nil, fmt.Errorf("reading faked key: %s", err)
+	}
+	fs.key = strings.SplitN(strings.TrimSpace(line), ":", 2)[0]
+	if fs.key == "" {
+		fs.cmd.Process.Kill()
+		fs.cmd.Wait()
+		return nil, errors.New("faked did not report a key")
+	}
+	go io.Copy(ioutil.Discard, out)
+
+	Infof("Started faked session with key %s (pid %d).",
+		fs.key, fs.cmd.Process.Pid)
+	return fs, nil
+}
+
+// shellQuote quotes a string for use in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// WrapperArgs returns a command prefix that connects the wrapped command to
+// the session, the same way the fakeroot script does for its own daemon.
+func (fs *FakedSession) WrapperArgs() ([]string, error) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf("export FAKEROOTKEY=%s FAKED_MODE=unknown-is-root; "+
+		"export LD_LIBRARY_PATH=%s${LD_LIBRARY_PATH:+:$LD_LIBRARY_PATH}; "+
+		"export LD_PRELOAD=%s${LD_PRELOAD:+:$LD_PRELOAD}; "+
+		`exec "$@"`,
+		shellQuote(fs.key), shellQuote(fs.libPaths), shellQuote(fs.lib))
+	return []string{sh, "-c", script, "fakeroot-session"}, nil
+}
+
+// Checkpoint saves the state of the daemon, by stopping it and starting a
+// new one that loads the saved state. The daemon only reports that a save is
+// complete by exiting; a save requested with SIGUSR1 may still be partly
+// written when it is read. No command may be connected to the daemon.
+func (fs *FakedSession) Checkpoint() error {
+	if err := fs.Stop(); err != nil {
+		return err
+	}
+	next, err := StartFakedSession(fs.saveFile)
+	if err != nil {
+		return err
+	}
+	*fs = *next
+	Debugf("Saved faked state to '%s'.", fs.saveFile)
+	return nil
+}
+
+// Stop terminates the daemon, which saves its state on exit. Stopping a
+// stopped session does nothing.
+func (fs *FakedSession) Stop() error {
+	if fs.cmd == nil {
+		return nil
+	}
+	if err := fs.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	fs.cmd.Wait()
+	fs.cmd = nil
+	Infof("Stopped faked session with key %s.", fs.key)
+	return nil
+}
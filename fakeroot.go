@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+)
+
+// loadFakerootState reads the fakeroot save file of a rib directory, and maps
+// the rootfs inodes to paths.
+func loadFakerootState(workDir string) (string, []*FakerootEntry, map[inodeKey][]string, error) {
+	workDir, err := RealPath(workDir)
+	if err != nil {
+		Errorf("RealPath: %s", err)
+		return "", nil, nil, err
+	}
+
+	if !isRibDir(workDir) {
+		Errorf("No rib structure found in '%s'.", workDir)
+		return "", nil, nil, errors.New("invalid directory")
+	}
+
+	if err := CheckFakerootState(workDir); err != nil {
+		Errorf("CheckFakerootState: %s", err)
+		return "", nil, nil, err
+	}
+
+	entries, err := ReadFakerootSave(
+		filepath.Join(workDir, PATHNAME_FAKEROOTSAVE))
+	if err != nil {
+		Errorf("ReadFakerootSave: %s", err)
+		return "", nil, nil, err
+	}
+
+	inodes, err := MapRootfsInodes(filepath.Join(workDir, PATHNAME_ROOTFS))
+	if err != nil {
+		Errorf("MapRootfsInodes: %s", err)
+		return "", nil, nil, err
+	}
+
+	return workDir, entries, inodes, nil
+}
+
+// cmdFakerootLs lists the ownership and mode overrides recorded in the
+// fakeroot save file, mapped to paths in the rootfs.
+func cmdFakerootLs(workDir string) error {
+	_, entries, inodes, err := loadFakerootState(workDir)
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		path  string
+		entry *FakerootEntry
+	}
+	var rows []row
+	for _, e := range entries {
+		paths, ok := inodes[e.key()]
+		if !ok {
+			paths = []string{fmt.Sprintf("<stale dev=%x ino=%d>",
+				e.dev, e.ino)}
+		}
+		for _, p := range paths {
+			rows = append(rows, row{p, e})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].path < rows[j].path
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tOWNER\tMODE\tDEVICE")
+	for _, r := range rows {
+		dev := "-"
+		if r.entry.IsDevice() {
+			dev = fmt.Sprintf("%d,%d", r.entry.Major(), r.entry.Minor())
+		}
+		fmt.Fprintf(w, "%s\t%d:%d\t%o\t%s\n", r.path,
+			r.entry.uid, r.entry.gid, r.entry.mode, dev)
+	}
+	return w.Flush()
+}
+
+// cmdFakerootVerify reports fakeroot save file entries whose inodes no longer
+// exist in the rootfs.
+func cmdFakerootVerify(workDir string) error {
+	_, entries, inodes, err := loadFakerootState(workDir)
+	if err != nil {
+		return err
+	}
+
+	stale := 0
+	for _, e := range entries {
+		if _, ok := inodes[e.key()]; !ok {
+			fmt.Printf("stale: %s\n", e)
+			stale++
+		}
+	}
+	if stale > 0 {
+		return fmt.Errorf("%d of %d entries are stale", stale, len(entries))
+	}
+	return nil
+}
+
+// cmdFakerootSet changes the recorded owner and/or mode of a path in the
+// rootfs, adding a new fakeroot save file entry if needed.
+func cmdFakerootSet(workDir, pathname, owner, mode string) error {
+	if owner == "" && mode == "" {
+		return errors.New("nothing to set; specify owner and/or mode")
+	}
+
+	workDir, entries, _, err := loadFakerootState(workDir)
+	if err != nil {
+		return err
+	}
+	rootfs := filepath.Join(workDir, PATHNAME_ROOTFS)
+
+	fi, err := os.Lstat(filepath.Join(rootfs, pathname))
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("stat unavailable")
+	}
+
+	// Find the existing entry, or add one based on the real file,
+	// owned by root like any file unknown to fakeroot.
+	k := inodeKey{uint64(st.Dev), uint64(st.Ino)}
+	var entry *FakerootEntry
+	for _, e := range entries {
+		if e.key() == k {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		entry = &FakerootEntry{
+			dev:   k.dev,
+			ino:   k.ino,
+			mode:  st.Mode,
+			nlink: uint64(st.Nlink),
+		}
+		entries = append(entries, entry)
+	}
+
+	if owner != "" {
+		uid, gid, setGid, err := parseOwner(rootfs, owner)
+		if err != nil {
+			return err
+		}
+		entry.uid = uid
+		if setGid {
+			entry.gid = gid
+		}
+	}
+
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm&^07777 != 0 {
+			return fmt.Errorf("invalid mode %q", mode)
+		}
+		entry.mode = entry.mode&syscall.S_IFMT | uint32(perm)
+	}
+
+	Debugf("Setting '%s' to %s.", pathname, entry)
+	if err := WriteFakerootSave(
+		filepath.Join(workDir, PATHNAME_FAKEROOTSAVE), entries); err != nil {
+		return err
+	}
+	return WriteFakerootPaths(workDir)
+}
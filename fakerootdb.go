@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A FakerootEntry is a record in a fakeroot save file, holding the faked
+// ownership and mode of the file identified by its device and inode number.
+type FakerootEntry struct {
+	dev   uint64
+	ino   uint64
+	mode  uint32
+	uid   uint32
+	gid   uint32
+	nlink uint64
+	rdev  uint64
+	extra []string
+}
+
+// inodeKey identifies a file by device and inode number.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+func (e *FakerootEntry) key() inodeKey {
+	return inodeKey{e.dev, e.ino}
+}
+
+// String formats the entry the way faked(1) writes it.
+func (e *FakerootEntry) String() string {
+	s := fmt.Sprintf("dev=%x,ino=%d,mode=%o,uid=%d,gid=%d,nlink=%d,rdev=%d",
+		e.dev, e.ino, e.mode, e.uid, e.gid, e.nlink, e.rdev)
+	if len(e.extra) > 0 {
+		s += "," + strings.Join(e.extra, ",")
+	}
+	return s
+}
+
+// IsDevice checks whether the entry describes a device node.
+func (e *FakerootEntry) IsDevice() bool {
+	ft := e.mode & syscall.S_IFMT
+	return ft == syscall.S_IFCHR || ft == syscall.S_IFBLK
+}
+
+// Major and Minor split the device number of a device node entry.
+func (e *FakerootEntry) Major() uint64 {
+	return (e.rdev>>8)&0xfff | (e.rdev>>32)&^0xfff
+}
+
+func (e *FakerootEntry) Minor() uint64 {
+	return e.rdev&0xff | (e.rdev>>12)&^0xff
+}
+
+// parseFakerootEntry parses a single line of a fakeroot save file. Unknown
+// fields are preserved.
+func parseFakerootEntry(line string) (*FakerootEntry, error) {
+	e := &FakerootEntry{}
+	seen := 0
+	for _, field := range strings.Split(line, ",") {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed field %q", field)
+		}
+		name, value := field[:i], field[i+1:]
+
+		var err error
+		var v uint64
+		switch name {
+		case "dev":
+			v, err = strconv.ParseUint(value, 16, 64)
+			e.dev = v
+		case "ino":
+			v, err = strconv.ParseUint(value, 10, 64)
+			e.ino = v
+		case "mode":
+			v, err = strconv.ParseUint(value, 8, 32)
+			e.mode = uint32(v)
+		case "uid":
+			v, err = strconv.ParseUint(value, 10, 32)
+			e.uid = uint32(v)
+		case "gid":
+			v, err = strconv.ParseUint(value, 10, 32)
+			e.gid = uint32(v)
+		case "nlink":
+			v, err = strconv.ParseUint(value, 10, 64)
+			e.nlink = v
+		case "rdev":
+			v, err = strconv.ParseUint(value, 10, 64)
+			e.rdev = v
+		default:
+			e.extra = append(e.extra, field)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", name, err)
+		}
+		seen++
+	}
+	if seen < 7 {
+		return nil, fmt.Errorf("missing fields in %q", line)
+	}
+	return e, nil
+}
+
+// ReadFakerootSave reads all entries from a fakeroot save file.
+func ReadFakerootSave(pathname string) ([]*FakerootEntry, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*FakerootEntry
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		e, err := parseFakerootEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", pathname, n, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// WriteFakerootSave replaces the fakeroot save file with the given entries.
+// The file is written to a temporary file and renamed into place.
+func WriteFakerootSave(pathname string, entries []*FakerootEntry) error {
+	f, err := ioutil.TempFile(filepath.Dir(pathname),
+		"."+filepath.Base(pathname)+".")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		fmt.Fprintln(w, e.String())
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), pathname)
+}
+
+// MapRootfsInodes walks the root filesystem and maps each device and inode
+// number to the paths referring to it, as seen from inside the rootfs.
+func MapRootfsInodes(rootfs string) (map[inodeKey][]string, error) {
+	inodes := make(map[inodeKey][]string)
+	err := filepath.Walk(rootfs, func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfs, pathname)
+		if err != nil {
+			return err
+		}
+		k := inodeKey{uint64(st.Dev), uint64(st.Ino)}
+		inodes[k] = append(inodes[k], filepath.Join("/", rel))
+		return nil
+	})
+	return inodes, err
+}
+
+// lookupColonFile finds the numeric id of a named entry in a passwd(5) or
+// group(5) style file.
+func lookupColonFile(pathname, name string) (uint32, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) >= 3 && fields[0] == name {
+			id, err := strconv.ParseUint(fields[2], 10, 32)
+			return uint32(id), err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("'%s' not found in '%s'", name, pathname)
+}
+
+// parseOwner parses an owner specification on the form "user[:group]",
+// where user and group are numeric ids or names looked up in the rootfs.
+func parseOwner(rootfs, owner string) (uid, gid uint32, setGid bool, err error) {
+	lookup := func(name, file string) (uint32, error) {
+		if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+			return uint32(id), nil
+		}
+		return lookupColonFile(filepath.Join(rootfs, "etc", file), name)
+	}
+
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] == "" {
+		return 0, 0, false, fmt.Errorf("invalid owner %q", owner)
+	}
+	if uid, err = lookup(parts[0], "passwd"); err != nil {
+		return 0, 0, false, err
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		if gid, err = lookup(parts[1], "group"); err != nil {
+			return 0, 0, false, err
+		}
+		setGid = true
+	}
+	return uid, gid, setGid, nil
+}
+
+// A fakerootPathRecord is a fakeroot save file entry keyed by its path inside
+// the rootfs, as stored in the fakeroot path sidecar file.
+type fakerootPathRecord struct {
+	path  string
+	entry *FakerootEntry
+}
+
+// statInode returns the device and inode number of a path.
+func statInode(pathname string) (inodeKey, error) {
+	fi, err := os.Lstat(pathname)
+	if err != nil {
+		return inodeKey{}, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inodeKey{}, fmt.Errorf("stat unavailable for '%s'", pathname)
+	}
+	return inodeKey{uint64(st.Dev), uint64(st.Ino)}, nil
+}
+
+// readFakerootPaths reads the fakeroot path sidecar file, returning the
+// recorded identity of the rootfs directory and the path-keyed entries.
+func readFakerootPaths(pathname string) (inodeKey, []fakerootPathRecord, error) {
+	var rootKey inodeKey
+	var records []fakerootPathRecord
+
+	f, err := os.Open(pathname)
+	if err != nil {
+		return rootKey, nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if strings.HasPrefix(line, "#rootfs ") {
+			_, err := fmt.Sscanf(line, "#rootfs dev=%x,ino=%d",
+				&rootKey.dev, &rootKey.ino)
+			if err != nil {
+				return rootKey, nil, fmt.Errorf("%s:%d: %s",
+					pathname, n, err)
+			}
+			continue
+		}
+		i := strings.IndexByte(line, '\t')
+		if i < 0 {
+			return rootKey, nil, fmt.Errorf("%s:%d: missing path",
+				pathname, n)
+		}
+		e, err := parseFakerootEntry(line[:i])
+		if err != nil {
+			return rootKey, nil, fmt.Errorf("%s:%d: %s",
+				pathname, n, err)
+		}
+		path, err := strconv.Unquote(line[i+1:])
+		if err != nil {
+			return rootKey, nil, fmt.Errorf("%s:%d: %s",
+				pathname, n, err)
+		}
+		records = append(records, fakerootPathRecord{path, e})
+	}
+	if err := s.Err(); err != nil {
+		return rootKey, nil, err
+	}
+	return rootKey, records, nil
+}
+
+// WriteFakerootPaths records the fakeroot save file entries keyed by path,
+// along with the identity of the rootfs directory. This sidecar file allows
+// rebuilding the save file when the rootfs inodes change. It walks the whole
+// rootfs, so it is only called at checkpoints and when a build ends.
+func WriteFakerootPaths(workDir string) error {
+	rootfs := filepath.Join(workDir, PATHNAME_ROOTFS)
+	entries, err := ReadFakerootSave(
+		filepath.Join(workDir, PATHNAME_FAKEROOTSAVE))
+	if err != nil {
+		return err
+	}
+	rootKey, err := statInode(rootfs)
+	if err != nil {
+		return err
+	}
+	inodes, err := MapRootfsInodes(rootfs)
+	if err != nil {
+		return err
+	}
+
+	pathname := filepath.Join(workDir, PATHNAME_FAKEROOTPATHS)
+	f, err := ioutil.TempFile(workDir, "."+PATHNAME_FAKEROOTPATHS+".")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#rootfs dev=%x,ino=%d\n", rootKey.dev, rootKey.ino)
+	for _, e := range entries {
+		for _, p := range inodes[e.key()] {
+			fmt.Fprintf(w, "%s\t%s\n", e, strconv.Quote(p))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), pathname)
+}
+
+// warnLoudly logs a warning and also prints it on the console, regardless of
+// the verbosity level.
+func warnLoudly(format string, v ...interface{}) {
+	Warningf(format, v...)
+	fmt.Fprintf(consoleOut, "WARNING: "+format+"\n", v...)
+}
+
+// CheckFakerootState verifies that the fakeroot save file still matches the
+// rootfs inodes. If the rootfs has been copied, restored or moved to another
+// filesystem, the save file is rebuilt from the path sidecar file.
+func CheckFakerootState(workDir string) error {
+	rootfs := filepath.Join(workDir, PATHNAME_ROOTFS)
+	saveFile := filepath.Join(workDir, PATHNAME_FAKEROOTSAVE)
+
+	rootKey, records, err := readFakerootPaths(
+		filepath.Join(workDir, PATHNAME_FAKEROOTPATHS))
+	if os.IsNotExist(err) {
+		return checkFakerootSaveInodes(rootfs, saveFile)
+	}
+	if err != nil {
+		warnLoudly("Cannot verify fakeroot state: %s", err)
+		return nil
+	}
+
+	curKey, err := statInode(rootfs)
+	if err != nil {
+		return err
+	}
+	if curKey == rootKey && !fakerootPathsMoved(rootfs, records) {
+		return nil
+	}
+
+	warnLoudly("The rootfs inodes no longer match '%s'; rebuilding it "+
+		"from '%s'.", PATHNAME_FAKEROOTSAVE, PATHNAME_FAKEROOTPATHS)
+
+	var entries []*FakerootEntry
+	seen := make(map[inodeKey]bool)
+	missing := 0
+	for _, r := range records {
+		k, err := statInode(filepath.Join(rootfs, r.path))
+		if err != nil {
+			missing++
+			continue
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		e := *r.entry
+		e.dev, e.ino = k.dev, k.ino
+		entries = append(entries, &e)
+	}
+	if missing > 0 {
+		warnLoudly("%d recorded paths are missing from the rootfs; "+
+			"their ownership information is lost.", missing)
+	}
+
+	if err := WriteFakerootSave(saveFile, entries); err != nil {
+		return err
+	}
+	return WriteFakerootPaths(workDir)
+}
+
+// Number of recorded paths whose inodes are checked against the rootfs.
+const fakerootPathSamples = 64
+
+// fakerootPathsMoved checks a sample of the recorded paths, spread over the
+// sidecar file, and reports whether most of those still present in the rootfs
+// now have other inodes. This happens when the rootfs contents are restored
+// or synced in place, which keeps the rootfs directory itself. A few changed
+// inodes are expected, from files replaced since the sidecar was written.
+func fakerootPathsMoved(rootfs string, records []fakerootPathRecord) bool {
+	step := 1
+	if len(records) > fakerootPathSamples {
+		step = len(records) / fakerootPathSamples
+	}
+	checked, moved := 0, 0
+	for i := 0; i < len(records); i += step {
+		r := records[i]
+		k, err := statInode(filepath.Join(rootfs, r.path))
+		if err != nil {
+			continue
+		}
+		checked++
+		if k != r.entry.key() {
+			moved++
+		}
+	}
+	return checked > 0 && moved*2 > checked
+}
+
+// checkFakerootSaveInodes warns if none of the fakeroot save file entries
+// refer to inodes in the rootfs, which happens when the rootfs has moved
+// and there is no path sidecar file to rebuild the save file from.
+func checkFakerootSaveInodes(rootfs, saveFile string) error {
+	entries, err := ReadFakerootSave(saveFile)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	inodes, err := MapRootfsInodes(rootfs)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, ok := inodes[e.key()]; ok {
+			return nil
+		}
+	}
+	warnLoudly("None of the %d entries in '%s' match the rootfs inodes; "+
+		"ownership information is lost.", len(entries), PATHNAME_FAKEROOTSAVE)
+	return nil
+}
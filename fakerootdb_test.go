@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFakerootEntry(t *testing.T) {
+	line := "dev=fe00,ino=9617440,mode=20660,uid=0,gid=6,nlink=1,rdev=2049"
+	e, err := parseFakerootEntry(line)
+	if err != nil {
+		t.Fatalf("parseFakerootEntry(%q) failed: %s", line, err)
+	}
+	if e.dev != 0xfe00 || e.ino != 9617440 || e.mode != 020660 ||
+		e.uid != 0 || e.gid != 6 || e.nlink != 1 || e.rdev != 2049 {
+		t.Fatalf("parseFakerootEntry(%q): got %+v", line, e)
+	}
+	if !e.IsDevice() || e.Major() != 8 || e.Minor() != 1 {
+		t.Fatalf("Device %d,%d: want 8,1", e.Major(), e.Minor())
+	}
+	if e.String() != line {
+		t.Fatalf("String(): got %q, want %q", e.String(), line)
+	}
+
+	// Unknown fields are preserved.
+	line = "dev=1,ino=2,mode=100644,uid=3,gid=4,nlink=1,rdev=0,foo=bar"
+	e, err = parseFakerootEntry(line)
+	if err != nil {
+		t.Fatalf("parseFakerootEntry(%q) failed: %s", line, err)
+	}
+	if e.String() != line {
+		t.Fatalf("String(): got %q, want %q", e.String(), line)
+	}
+
+	for _, line := range []string{
+		"",
+		"dev=1,ino=2",
+		"dev=xyz,ino=2,mode=100644,uid=3,gid=4,nlink=1,rdev=0",
+		"dev=1,ino=2,mode=100648,uid=3,gid=4,nlink=1,rdev=0",
+		"dev=1,ino=2,mode,uid=3,gid=4,nlink=1,rdev=0",
+	} {
+		if _, err := parseFakerootEntry(line); err == nil {
+			t.Fatalf("parseFakerootEntry(%q) did not fail.", line)
+		}
+	}
+}
+
+func TestFakerootPathsMoved(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	var records []fakerootPathRecord
+	for _, name := range []string{"a", "b", "c", "d"} {
+		pathname := filepath.Join(rootfs, name)
+		if err := ioutil.WriteFile(pathname, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		k, err := statInode(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, fakerootPathRecord{"/" + name,
+			&FakerootEntry{dev: k.dev, ino: k.ino}})
+	}
+	if fakerootPathsMoved(rootfs, records) {
+		t.Fatalf("Unchanged paths reported as moved.")
+	}
+
+	// Replacing a file changes its inode.
+	replace := func(name string) {
+		pathname := filepath.Join(rootfs, name)
+		if err := ioutil.WriteFile(pathname+".new", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(pathname+".new", pathname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace("a")
+	os.Remove(filepath.Join(rootfs, "b"))
+	if fakerootPathsMoved(rootfs, records) {
+		t.Fatalf("A single replaced path reported as moved.")
+	}
+	replace("c")
+	replace("d")
+	if !fakerootPathsMoved(rootfs, records) {
+		t.Fatalf("Replaced paths not reported as moved.")
+	}
+}
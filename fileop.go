@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 func EnsureFile(pathname string) error {
@@ -129,3 +131,50 @@ func RealPath(dir string) (string, error) {
 
 	return realDir, nil
 }
+
+// ResolveInRoot resolves a path as seen from inside the given root
+// directory, following symlinks without escaping the root. Absolute symlink
+// targets are interpreted relative to the root. It returns the resolved
+// host path.
+func ResolveInRoot(root, pathname string) (string, error) {
+	const maxLinks = 40
+	links := 0
+
+	resolved := "/"
+	rest := strings.Split(filepath.Clean("/"+pathname), "/")
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
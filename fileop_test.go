@@ -296,3 +296,49 @@ func TestCopyFile(t *testing.T) {
 		t.Fatalf("Content mismatch: %s != %s", dstdata, srcdata)
 	}
 }
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "test.fileop.")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// Build a small root filesystem with a merged /usr layout.
+	if err := os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+	if err := EnsureFile(filepath.Join(root, "usr", "bin", "dash")); err != nil {
+		t.Fatalf("EnsureFile failed: %s", err)
+	}
+	for _, l := range []struct{ target, name string }{
+		{"usr/bin", "bin"},
+		{"dash", "usr/bin/sh"},
+		{"/bin/sh", "usr/bin/abs"},
+		{"../../../../bin/sh", "usr/bin/up"},
+		{"/usr/bin/loop", "usr/bin/loop"},
+	} {
+		if err := os.Symlink(l.target, filepath.Join(root, l.name)); err != nil {
+			t.Fatalf("Symlink(%s) failed: %s", l.name, err)
+		}
+	}
+
+	want := filepath.Join(root, "usr", "bin", "dash")
+	for _, p := range []string{"/bin/sh", "/usr/bin/abs", "/usr/bin/up", "bin/dash"} {
+		got, err := ResolveInRoot(root, p)
+		if err != nil {
+			t.Fatalf("ResolveInRoot(%s) failed: %s", p, err)
+		}
+		if got != want {
+			t.Fatalf("ResolveInRoot(%s): got '%s', want '%s'", p, got, want)
+		}
+	}
+
+	if _, err := ResolveInRoot(root, "/bin/bash"); !os.IsNotExist(err) {
+		t.Fatalf("ResolveInRoot(/bin/bash) did not fail with ENOENT: %v", err)
+	}
+
+	if _, err := ResolveInRoot(root, "/usr/bin/loop"); err == nil {
+		t.Fatalf("ResolveInRoot(symlink loop) did not fail.")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GeneratedParts returns command environments for the scripts registered by
+// the finished command. Generated scripts must be executable files in the tmp
+// directory, named like build scripts. Skipped scripts are left out.
+func (ce *CmdEnv) GeneratedParts(config Directives) ([]*CmdEnv, error) {
+	tmpDir := filepath.Join(ce.workDir, PATHNAME_TMP)
+
+	var celist []*CmdEnv
+	for _, script := range ce.scripts {
+		pathname := ce.hostPath(script)
+		rel, err := filepath.Rel(tmpDir, pathname)
+		if err != nil || rel == "." || rel == ".." ||
+			strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("generated script '%s' is outside "+
+				"the %s directory", script, PATHNAME_TMP)
+		}
+		fi, err := os.Stat(pathname)
+		if err != nil {
+			return nil, fmt.Errorf("generated script '%s': %s",
+				script, err)
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+			return nil, fmt.Errorf("generated script '%s' is not an "+
+				"executable file", script)
+		}
+
+		gce := &CmdEnv{name: filepath.Base(pathname), origin: ce.name}
+		gce.Path = pathname
+		gce.Args = []string{gce.Path}
+		if _, gce.flag, err = parseScriptName(gce.name); err != nil {
+			return nil, fmt.Errorf("generated script '%s': %s",
+				script, err)
+		}
+		if gce.flag&Eskip != 0 {
+			Infof("Skipping script '%s' generated by '%s'.",
+				gce.name, ce.name)
+			continue
+		}
+		if err := gce.prepareScript(config); err != nil {
+			return nil, err
+		}
+		celist = append(celist, gce)
+	}
+	return celist, nil
+}
+
+// insertParts adds generated command environments to the commands pending
+// after the one at index i, which generated them, and re-sorts the pending
+// commands by name, like the scripts read from the build directory.
+// Generated scripts must sort after the generating script, and names must be
+// unique.
+func insertParts(celist []*CmdEnv, i int, added []*CmdEnv) ([]*CmdEnv, error) {
+	names := make(map[string]bool)
+	for _, ce := range celist {
+		names[ce.name] = true
+	}
+	for _, ce := range added {
+		if ce.name <= celist[i].name {
+			return nil, fmt.Errorf("generated script '%s' does not "+
+				"sort after '%s'", ce.name, celist[i].name)
+		}
+		if names[ce.name] {
+			return nil, fmt.Errorf("duplicate script name '%s'",
+				ce.name)
+		}
+		names[ce.name] = true
+		celist = append(celist, ce)
+	}
+
+	pending := celist[i+1:]
+	sort.SliceStable(pending, func(a, b int) bool {
+		return pending[a].name < pending[b].name
+	})
+	for _, ce := range added {
+		for j, p := range pending {
+			if p == ce {
+				Infof("Adding script '%s' from '%s', at "+
+					"position %d of %d.", ce.name, ce.origin,
+					i+2+j, len(celist))
+			}
+		}
+	}
+	return celist, nil
+}
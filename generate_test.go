@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInsertParts(t *testing.T) {
+	var celist []*CmdEnv
+	for _, name := range []string{"10--a", "20--gen", "30--b", "50--c"} {
+		celist = append(celist, &CmdEnv{name: name})
+	}
+	added := []*CmdEnv{
+		{name: "40--flavour-rt", origin: "20--gen"},
+		{name: "25--flavour-amd64", origin: "20--gen"},
+	}
+	celist, err := insertParts(celist, 1, added)
+	if err != nil {
+		t.Fatalf("insertParts: %s", err)
+	}
+	want := []string{"10--a", "20--gen", "25--flavour-amd64", "30--b",
+		"40--flavour-rt", "50--c"}
+	if len(celist) != len(want) {
+		t.Fatalf("insertParts: got %d commands, want %d", len(celist),
+			len(want))
+	}
+	for i, ce := range celist {
+		if ce.name != want[i] {
+			t.Errorf("insertParts: command %d is %q, want %q", i,
+				ce.name, want[i])
+		}
+	}
+
+	for _, name := range []string{"15--early", "20--gen", "30--b"} {
+		if _, err := insertParts(celist, 1,
+			[]*CmdEnv{{name: name}}); err == nil {
+			t.Errorf("insertParts(%q): got no error", name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Prefix marking a directive line in a script header.
+const headerPrefix = "rib:"
+
+// Maximum number of lines scanned for header directives.
+const headerMaxLines = 64
+
+// Directives holds key-value settings read from a script header or the work
+// directory configuration file. A key may be given more than once; the last
+// value wins for single-value settings.
+type Directives map[string][]string
+
+// Get returns the last value given for the key.
+func (d Directives) Get(key string) (string, bool) {
+	v := d[key]
+	if len(v) == 0 {
+		return "", false
+	}
+	return v[len(v)-1], true
+}
+
+// GetBool returns the last value given for the key, which must be "yes" or
+// "no".
+func (d Directives) GetBool(key string) (value, ok bool, err error) {
+	v, ok := d.Get(key)
+	if !ok {
+		return false, false, nil
+	}
+	switch v {
+	case "yes":
+		return true, true, nil
+	case "no":
+		return false, true, nil
+	}
+	return false, false, fmt.Errorf("invalid %s value %q; want yes or no",
+		key, v)
+}
+
+// Add appends a value to the key.
+func (d Directives) Add(key, value string) {
+	d[key] = append(d[key], value)
+}
+
+// parseDirective splits a "key=value" string, trimming surrounding space.
+func parseDirective(s string) (key, value string, err error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return "", "", fmt.Errorf("missing '=' in directive %q", s)
+	}
+	key = strings.TrimSpace(s[:i])
+	value = strings.TrimSpace(s[i+1:])
+	if key == "" {
+		return "", "", fmt.Errorf("empty key in directive %q", s)
+	}
+	return key, value, nil
+}
+
+// readHeader scans the leading comment block of a script for directives on
+// the form "# rib: key=value". Scanning stops at the first line that is not
+// a comment or blank, so binaries and scripts without a header yield an
+// empty set.
+func readHeader(r io.Reader) (Directives, error) {
+	d := make(Directives)
+	br := bufio.NewReader(r)
+
+	// Only consider files starting with a comment or shebang.
+	if b, err := br.Peek(1); err != nil || b[0] != '#' {
+		return d, nil
+	}
+
+	s := bufio.NewScanner(br)
+	for n := 0; n < headerMaxLines && s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] != '#' {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimLeft(line, "#"))
+		if !strings.HasPrefix(line, headerPrefix) {
+			continue
+		}
+		key, value, err := parseDirective(
+			strings.TrimPrefix(line, headerPrefix))
+		if err != nil {
+			return nil, err
+		}
+		d.Add(key, value)
+	}
+	if err := s.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// ReadScriptHeader reads the header directives of the given script file.
+func ReadScriptHeader(pathname string) (Directives, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+// Merge returns a new set of directives holding the values of d followed by
+// those of o, so that values in o take precedence.
+func (d Directives) Merge(o Directives) Directives {
+	m := make(Directives)
+	for _, src := range []Directives{d, o} {
+		for key, values := range src {
+			for _, value := range values {
+				m.Add(key, value)
+			}
+		}
+	}
+	return m
+}
+
+// readConfig parses a configuration file of "key=value" lines. Blank lines
+// and lines starting with '#' are ignored.
+func readConfig(r io.Reader) (Directives, error) {
+	d := make(Directives)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, value, err := parseDirective(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		d.Add(key, value)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ReadConfig reads the work directory configuration file. A missing file
+// yields an empty set of directives.
+func ReadConfig(pathname string) (Directives, error) {
+	f, err := os.Open(pathname)
+	if os.IsNotExist(err) {
+		return make(Directives), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := readConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pathname, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	script := "#!/bin/sh\n" +
+		"# Install packages.\n" +
+		"# rib: rlimit-cpu=60\n" +
+		"#rib: rlimit-nofile = 1024:4096\n" +
+		"\n" +
+		"# rib: rlimit-cpu=120\n" +
+		"set -e\n" +
+		"# rib: rlimit-as=1\n"
+
+	d, err := readHeader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("readHeader() failed: %s", err)
+	}
+
+	if v, _ := d.Get("rlimit-cpu"); v != "120" {
+		t.Fatalf("rlimit-cpu: got %q, want %q", v, "120")
+	}
+	if v, _ := d.Get("rlimit-nofile"); v != "1024:4096" {
+		t.Fatalf("rlimit-nofile: got %q, want %q", v, "1024:4096")
+	}
+	if _, ok := d.Get("rlimit-as"); ok {
+		t.Fatalf("Directive after header end was parsed.")
+	}
+
+	// A binary file has no header.
+	d, err = readHeader(strings.NewReader("\x7fELF\x02\x01\x01"))
+	if err != nil {
+		t.Fatalf("readHeader(binary) failed: %s", err)
+	}
+	if len(d) != 0 {
+		t.Fatalf("readHeader(binary) returned directives: %v", d)
+	}
+
+	// A malformed directive is an error.
+	_, err = readHeader(strings.NewReader("#!/bin/sh\n# rib: rlimit-cpu\n"))
+	if err == nil {
+		t.Fatalf("readHeader(malformed) did not fail.")
+	}
+}
+
+func TestParseRlimits(t *testing.T) {
+	for _, value := range []string{"60", "60:120", "unlimited", ":100", "10:"} {
+		d := Directives{"rlimit-cpu": {value}}
+		rlimits, err := parseRlimits(d)
+		if err != nil {
+			t.Fatalf("parseRlimits(%q) failed: %s", value, err)
+		}
+		if rlimits["cpu"] != value {
+			t.Fatalf("parseRlimits(%q): got %q", value, rlimits["cpu"])
+		}
+	}
+
+	for _, value := range []string{"", ":", "-1", "1G", "1:2:3"} {
+		d := Directives{"rlimit-cpu": {value}}
+		if _, err := parseRlimits(d); err == nil {
+			t.Fatalf("parseRlimits(%q) did not fail.", value)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum depth of interpreter scripts, as in the Linux kernel.
+const interpMaxDepth = 4
+
+// readShebang returns the interpreter named on the "#!" line starting the
+// given file contents, and its optional argument, which is the rest of the
+// line. The interpreter is an empty string if there is none.
+func readShebang(r io.Reader) (interp, arg string, err error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return "", "", nil
+	}
+	interp = strings.TrimSpace(line[2:])
+	if i := strings.IndexAny(interp, " \t"); i >= 0 {
+		interp, arg = interp[:i], strings.TrimSpace(interp[i:])
+	}
+	return interp, arg, nil
+}
+
+// envCommand returns the command run by env(1) with the given arguments from
+// a shebang line, skipping options and variable assignments, or an empty
+// string if there is none.
+func envCommand(arg string) string {
+	fields := strings.Fields(arg)
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case f == "-u" || f == "--unset" || f == "-C" || f == "--chdir":
+			i++
+		case f == "--":
+		case strings.HasPrefix(f, "-"):
+		case strings.Contains(f, "="):
+		default:
+			return f
+		}
+	}
+	return ""
+}
+
+// lookPathInRoot finds an executable inside the root filesystem in the
+// directories of the given PATH, like the shell does, unless it is a path.
+func lookPathInRoot(rootfs, name, path, desc string) (string, error) {
+	if strings.Contains(name, "/") {
+		return checkInRoot(rootfs, name, desc, true)
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		resolved, err := checkInRoot(rootfs, filepath.Join(dir, name),
+			desc, true)
+		if err == nil {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in rootfs PATH '%s'", desc, path)
+}
+
+// elfInterpreter returns the dynamic loader requested by an ELF executable,
+// or an empty string for static executables and non-ELF files.
+func elfInterpreter(pathname string) (string, error) {
+	f, err := elf.Open(pathname)
+	if err != nil {
+		if _, ok := err.(*elf.FormatError); ok {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		buf := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(buf, 0); err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\x00"), nil
+	}
+	return "", nil
+}
+
+// checkInRoot verifies that a path inside the root filesystem refers to a
+// regular file, executable if requested, and returns its resolved host path.
+// The description names the file in error messages.
+func checkInRoot(rootfs, pathname, desc string, executable bool) (string, error) {
+	resolved, err := ResolveInRoot(rootfs, pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%s not found in rootfs", desc)
+		}
+		return "", fmt.Errorf("%s: %s", desc, err)
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", desc, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", desc)
+	}
+	if executable && fi.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%s is not executable", desc)
+	}
+	return resolved, nil
+}
+
+// CheckInterpreter verifies that the interpreter named by the script's
+// shebang line, and the dynamic loader of the final ELF executable, exist in
+// the root filesystem. For an interpreter run through env(1), the command it
+// runs is looked up in the given PATH. The script itself is a host path.
+func CheckInterpreter(rootfs, script, path string) error {
+	desc := fmt.Sprintf("script '%s'", filepath.Base(script))
+	resolved := script
+	for depth := 0; ; depth++ {
+		f, err := os.Open(resolved)
+		if err != nil {
+			return err
+		}
+		interp, arg, err := readShebang(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if interp == "" {
+			break
+		}
+		if depth == interpMaxDepth {
+			return fmt.Errorf("too many levels of interpreters for %s",
+				desc)
+		}
+		desc = fmt.Sprintf("interpreter '%s' of %s", interp, desc)
+		resolved, err = checkInRoot(rootfs, interp, desc, true)
+		if err != nil {
+			return err
+		}
+		if filepath.Base(interp) != "env" {
+			continue
+		}
+
+		// Check the command run by env instead, which is found in
+		// the PATH of the script.
+		cmd := envCommand(arg)
+		if cmd == "" {
+			break
+		}
+		desc = fmt.Sprintf("command '%s' of %s", cmd, desc)
+		resolved, err = lookPathInRoot(rootfs, cmd, path, desc)
+		if err != nil {
+			return err
+		}
+	}
+
+	loader, err := elfInterpreter(resolved)
+	if err != nil {
+		return fmt.Errorf("%s: %s", desc, err)
+	}
+	if loader == "" {
+		return nil
+	}
+	_, err = checkInRoot(rootfs, loader,
+		fmt.Sprintf("dynamic loader '%s' of %s", loader, desc), false)
+	return err
+}
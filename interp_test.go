@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadShebang(t *testing.T) {
+	for _, tc := range []struct{ in, interp, arg string }{
+		{"#!/bin/sh\necho\n", "/bin/sh", ""},
+		{"#! /usr/bin/env python3 -u\n", "/usr/bin/env", "python3 -u"},
+		{"#!/bin/bash\t-e \n", "/bin/bash", "-e"},
+		{"#!/bin/bash", "/bin/bash", ""},
+		{"#!\n", "", ""},
+		{"# rib: rlimit-cpu=1\n", "", ""},
+		{"\x7fELF", "", ""},
+		{"", "", ""},
+	} {
+		interp, arg, err := readShebang(strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatalf("readShebang(%q) failed: %s", tc.in, err)
+		}
+		if interp != tc.interp || arg != tc.arg {
+			t.Fatalf("readShebang(%q): got %q, %q, want %q, %q",
+				tc.in, interp, arg, tc.interp, tc.arg)
+		}
+	}
+}
+
+func TestEnvCommand(t *testing.T) {
+	for in, want := range map[string]string{
+		"python3":                  "python3",
+		"-S python3 -u":            "python3",
+		"-u HOME -C /tmp FOO=1 sh": "sh",
+		"-i":                       "",
+		"":                         "",
+	} {
+		if got := envCommand(in); got != want {
+			t.Fatalf("envCommand(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckInterpreter(t *testing.T) {
+	root, err := ioutil.TempDir("", "test.interp.")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "bin"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+	for name, content := range map[string]string{
+		"rootfs/bin/wrapper": "#!/bin/missing\n",
+		"rootfs/bin/noexec":  "#!/bin/sh\n",
+		"rootfs/bin/env":     "echo\n",
+		"rootfs/bin/tool":    "echo\n",
+		"ok":                 "echo\n",
+		"envok":              "#!/bin/env -S tool -x\n",
+		"envmissing":         "#!/bin/env python3\n",
+		"bash":               "#!/bin/bash\n",
+		"nested":             "#!/bin/wrapper\n",
+		"noexec":             "#!/bin/noexec\n",
+	} {
+		mode := os.FileMode(0755)
+		if name == "rootfs/bin/noexec" {
+			mode = 0644
+		}
+		err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), mode)
+		if err != nil {
+			t.Fatalf("WriteFile(%s) failed: %s", name, err)
+		}
+	}
+
+	for _, name := range []string{"ok", "envok"} {
+		err := CheckInterpreter(rootfs, filepath.Join(root, name), "/usr/bin:/bin")
+		if err != nil {
+			t.Fatalf("CheckInterpreter(%s) failed: %s", name, err)
+		}
+	}
+	for name, want := range map[string]string{
+		"envmissing": "command 'python3' of interpreter '/bin/env' of script 'envmissing' not found in rootfs PATH",
+		"bash":       "interpreter '/bin/bash' of script 'bash' not found",
+		"nested":     "interpreter '/bin/missing' of interpreter '/bin/wrapper'",
+		"noexec":     "is not executable",
+	} {
+		err := CheckInterpreter(rootfs, filepath.Join(root, name), "/usr/bin:/bin")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("CheckInterpreter(%s): got %v, want %q", name, err, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// Resource limits that scripts can declare in their header, mapped to the
+// corresponding prlimit(1) option.
+var rlimitDirectives = []struct {
+	directive string
+	option    string
+}{
+	{"rlimit-cpu", "cpu"},
+	{"rlimit-as", "as"},
+	{"rlimit-nofile", "nofile"},
+	{"rlimit-fsize", "fsize"},
+	{"rlimit-nproc", "nproc"},
+	{"rlimit-core", "core"},
+}
+
+// Match limit values on the form "N", "soft:hard", "soft:" or ":hard",
+// where each limit is a number or "unlimited".
+var rlimitValueRe = regexp.MustCompile(
+	`^(\d+|unlimited)?(:(\d+|unlimited)?)?$`)
+
+// parseRlimits collects resource limit directives into a map of prlimit
+// options and limit values.
+func parseRlimits(d Directives) (map[string]string, error) {
+	rlimits := make(map[string]string)
+	for _, rd := range rlimitDirectives {
+		value, ok := d.Get(rd.directive)
+		if !ok {
+			continue
+		}
+		if value == "" || value == ":" || !rlimitValueRe.MatchString(value) {
+			return nil, fmt.Errorf("invalid %s value %q",
+				rd.directive, value)
+		}
+		rlimits[rd.option] = value
+	}
+	return rlimits, nil
+}
+
+// ResourceUsage holds resource usage accounting for executed commands.
+// Maxrss is in kilobytes; Inblock and Oublock count filesystem block I/O
+// operations.
+type ResourceUsage struct {
+	Utime   time.Duration
+	Stime   time.Duration
+	Maxrss  int64
+	Inblock int64
+	Oublock int64
+}
+
+// NewResourceUsage converts a rusage structure to a ResourceUsage.
+func NewResourceUsage(ru *syscall.Rusage) ResourceUsage {
+	return ResourceUsage{
+		Utime:   time.Duration(ru.Utime.Nano()),
+		Stime:   time.Duration(ru.Stime.Nano()),
+		Maxrss:  int64(ru.Maxrss),
+		Inblock: int64(ru.Inblock),
+		Oublock: int64(ru.Oublock),
+	}
+}
+
+// Add accumulates another usage record. CPU time and block I/O are summed,
+// while the maximum resident set size is the largest seen.
+func (u *ResourceUsage) Add(o ResourceUsage) {
+	u.Utime += o.Utime
+	u.Stime += o.Stime
+	u.Inblock += o.Inblock
+	u.Oublock += o.Oublock
+	if o.Maxrss > u.Maxrss {
+		u.Maxrss = o.Maxrss
+	}
+}
+
+func (u ResourceUsage) String() string {
+	return fmt.Sprintf("user=%s sys=%s maxrss=%dKiB inblock=%d oublock=%d",
+		u.Utime, u.Stime, u.Maxrss, u.Inblock, u.Oublock)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Interval between checks for new output of a running build.
+const followInterval = 250 * time.Millisecond
+
+// Options for the log show command.
+type logShowOptions struct {
+	build  string
+	script string
+	level  Level
+	stream string
+	follow bool
+}
+
+// openLogWorkDir resolves and checks the work directory for the log commands.
+func openLogWorkDir(workDir string) (string, error) {
+	workDir, err := RealPath(workDir)
+	if err != nil {
+		Errorf("RealPath: %s", err)
+		return "", err
+	}
+	if !isRibDir(workDir) {
+		Errorf("No rib structure found in '%s'.", workDir)
+		return "", errors.New("invalid directory")
+	}
+	return workDir, nil
+}
+
+// cmdLogList lists the logged builds, with their outcome and duration.
+func cmdLogList(workDir string) error {
+	workDir, err := openLogWorkDir(workDir)
+	if err != nil {
+		return err
+	}
+	ids, err := ListBuilds(workDir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BUILD\tSTARTED\tDURATION\tSCRIPTS\tOUTCOME")
+	for _, id := range ids {
+		s, err := ReadBuildStatus(workDir, id)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\tunknown\n", id)
+			continue
+		}
+		duration := s.Duration
+		if s.Outcome == outcomeRunning {
+			duration = time.Since(s.Start)
+		}
+		outcome := s.Outcome
+		if s.DryRun {
+			outcome += " (dry run)"
+		}
+		for _, script := range s.Scripts {
+			if script.Outcome == outcomeFailed {
+				outcome += fmt.Sprintf(" in '%s'", script.Name)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", id,
+			s.Start.Local().Format("2006-01-02 15:04:05"),
+			duration.Round(100*time.Millisecond), len(s.Scripts),
+			outcome)
+	}
+	return w.Flush()
+}
+
+// findBuild returns the ID of the build given by a unique ID prefix, or of
+// the latest build.
+func findBuild(workDir, build string) (string, error) {
+	ids, err := ListBuilds(workDir)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", errors.New("no builds logged")
+	}
+	if build == "" || build == "latest" {
+		return ids[len(ids)-1], nil
+	}
+
+	var found []string
+	for _, id := range ids {
+		if id == build {
+			return id, nil
+		}
+		if strings.HasPrefix(id, build) {
+			found = append(found, id)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no build '%s'", build)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("build '%s' is ambiguous: %s", build,
+		strings.Join(found, ", "))
+}
+
+// cmdLogShow prints the log of a build, filtered by level, script and output
+// stream. With follow, it keeps printing new messages until the build has
+// finished.
+func cmdLogShow(workDir string, opts *logShowOptions) error {
+	workDir, err := openLogWorkDir(workDir)
+	if err != nil {
+		return err
+	}
+	id, err := findBuild(workDir, opts.build)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(workDir, PATHNAME_LOG, PATHNAME_BUILDS,
+		id, PATHNAME_BUILDJSON))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var partial []byte
+	finished := !opts.follow
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == nil {
+			printLogLine(append(partial, line...), opts)
+			partial = nil
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		partial = append(partial, line...)
+		if finished {
+			break
+		}
+
+		// Read once more after the build has finished, to catch
+		// its last messages.
+		s, err := ReadBuildStatus(workDir, id)
+		if err != nil || s.Outcome != outcomeRunning {
+			finished = true
+			continue
+		}
+		time.Sleep(followInterval)
+	}
+	return nil
+}
+
+// printLogLine prints a JSON log line like in the text log, if it matches
+// the filters.
+func printLogLine(line []byte, opts *logShowOptions) {
+	var m jsonLogLine
+	if err := json.Unmarshal(line, &m); err != nil {
+		return
+	}
+	if level, err := ParseLevel(m.Level); err != nil || level < opts.level {
+		return
+	}
+	if opts.script != "" && m.Script != opts.script {
+		return
+	}
+	if opts.stream != "" && !strings.HasPrefix(m.Msg, "["+opts.stream+"] ") {
+		return
+	}
+	fmt.Printf("%s %s\n", m.Time,
+		strings.Trim(strconv.QuoteToASCII(m.Level+" "+m.Msg), `"`))
+}
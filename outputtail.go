@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// Default number of output lines kept per command, to be shown on failure.
+const defaultTailLines = 20
+
+// A lineRing keeps the last lines added to it.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// newLineRing returns a ring buffer for the given number of lines.
+func newLineRing(size int) *lineRing {
+	if size < 1 {
+		size = 1
+	}
+	return &lineRing{lines: make([]string, size)}
+}
+
+// Add adds a line, dropping the oldest one if the buffer is full.
+func (r *lineRing) Add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Lines returns the kept lines, oldest first.
+func (r *lineRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	return append(append([]string(nil), r.lines[r.next:]...),
+		r.lines[:r.next]...)
+}
+
+// logOutput logs a line of command output, and keeps it for the output tail.
+func (ce *CmdEnv) logOutput(format string, v ...interface{}) {
+	line := fmt.Sprintf(format, v...)
+	if ce.outputTail != nil {
+		ce.outputTail.Add(line)
+	}
+	Std.Output(2, LevelDebug, line)
+}
+
+// exitDescription describes how a command failed: its exit status, or the
+// signal that killed it.
+func exitDescription(err error) string {
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			switch {
+			case ws.Signaled():
+				return fmt.Sprintf("killed by signal %d (%s)",
+					ws.Signal(), ws.Signal())
+			case ws.Exited():
+				return fmt.Sprintf("exit status %d", ws.ExitStatus())
+			}
+		}
+	}
+	return err.Error()
+}
+
+// ReportFailure prints the failure of the command, with the last lines of
+// its output, and where to find the full log.
+func (ce *CmdEnv) ReportFailure(w io.Writer, err error, logPath string) {
+	name := ce.name
+	if flags := ce.FlagString(); flags != "" {
+		name = fmt.Sprintf("%s [%s]", ce.name, flags)
+	}
+	fmt.Fprintf(w, "Script '%s' failed: %s\n", name,
+		MaskSecrets(exitDescription(err)))
+
+	var lines []string
+	if ce.outputTail != nil {
+		lines = ce.outputTail.Lines()
+	}
+	if len(lines) == 0 {
+		fmt.Fprintf(w, "No output captured.\n")
+	} else {
+		plural := "s"
+		if len(lines) == 1 {
+			plural = ""
+		}
+		fmt.Fprintf(w, "Last %d line%s of output:\n", len(lines), plural)
+		for _, line := range lines {
+			fmt.Fprintf(w, "  %s\n", MaskSecrets(line))
+		}
+	}
+	fmt.Fprintf(w, "Full log: %s\n", logPath)
+}
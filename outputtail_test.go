@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLineRing(t *testing.T) {
+	r := newLineRing(3)
+	if got := r.Lines(); len(got) != 0 {
+		t.Fatalf("Lines: got %q, want none", got)
+	}
+	r.Add("a")
+	r.Add("b")
+	if got := strings.Join(r.Lines(), " "); got != "a b" {
+		t.Errorf("Lines: got %q, want %q", got, "a b")
+	}
+	r.Add("c")
+	if got := strings.Join(r.Lines(), " "); got != "a b c" {
+		t.Errorf("Lines: got %q, want %q", got, "a b c")
+	}
+	r.Add("d")
+	r.Add("e")
+	if got := strings.Join(r.Lines(), " "); got != "c d e" {
+		t.Errorf("Lines: got %q, want %q", got, "c d e")
+	}
+}
+
+func TestExitDescription(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"exit 3", "exit status 3"},
+		{"kill -9 $$", "killed by signal 9 (killed)"},
+	}
+	for _, test := range tests {
+		err := exec.Command("/bin/sh", "-c", test.script).Run()
+		if got := exitDescription(err); got != test.want {
+			t.Errorf("exitDescription(%q): got %q, want %q",
+				test.script, got, test.want)
+		}
+	}
+}
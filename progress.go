@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress display modes.
+const (
+	progressAuto  = "auto"
+	progressTTY   = "tty"
+	progressPlain = "plain"
+	progressNone  = "none"
+)
+
+// Number of output lines of the running script shown by the TTY display, and
+// the interval between redraws.
+const (
+	progressTailLines = 5
+	progressInterval  = time.Second
+)
+
+// consoleOut receives messages shown on the console regardless of the log
+// level. A TTY progress display takes it over, to print them above itself.
+var consoleOut io.Writer = os.Stderr
+
+// A Progress shows the progress of a build on the console: a status line for
+// the running script, with a step counter, the elapsed time and an estimate
+// of the remaining time, followed by the last lines of the script's output.
+// In plain mode, it prints a line as each script starts and finishes.
+type Progress struct {
+	out       *os.File
+	tty       bool
+	durations map[string]time.Duration
+	start     time.Time
+
+	mu       sync.Mutex
+	ce       *CmdEnv
+	step     int
+	pending  []*CmdEnv
+	scriptT0 time.Time
+	tail     []string
+	drawn    int
+	paused   bool
+	stop     chan bool
+	stopped  chan bool
+	lastDraw time.Time
+}
+
+// NewProgress returns a progress display in the given mode, writing to
+// stderr, or nil if there is nothing to show. Estimates are based on the
+// given durations of earlier runs of the scripts.
+func NewProgress(mode string, durations map[string]time.Duration) *Progress {
+	out := os.Stderr
+	if mode == progressAuto {
+		mode = progressPlain
+		if IsTerminal(out) {
+			mode = progressTTY
+		}
+	}
+	if mode != progressTTY && mode != progressPlain {
+		return nil
+	}
+	p := &Progress{
+		out:       out,
+		tty:       mode == progressTTY,
+		durations: durations,
+		start:     time.Now(),
+	}
+	if p.tty {
+		p.stop = make(chan bool)
+		p.stopped = make(chan bool)
+		go p.tick()
+		Std.AddFuncOutput(p.logged, LevelDebug)
+		consoleOut = p
+	}
+	return p
+}
+
+// Write prints console messages above the display, and redraws it. While
+// the display is paused, messages are written as they are, since the
+// interactive script owns the terminal.
+func (p *Progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return p.out.Write(b)
+	}
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw()
+	return n, err
+}
+
+// tick redraws the display periodically, to update the elapsed time.
+func (p *Progress) tick() {
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	defer close(p.stopped)
+	for {
+		select {
+		case <-t.C:
+			p.mu.Lock()
+			p.draw()
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// logged receives log messages, and keeps the output of the running script,
+// along with warnings and errors, for the tail region.
+func (p *Progress) logged(level Level, msg string) {
+	if level < LevelWarning && !strings.HasPrefix(msg, "[") {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ce == nil {
+		return
+	}
+	p.tail = append(p.tail, msg)
+	if len(p.tail) > progressTailLines {
+		p.tail = p.tail[len(p.tail)-progressTailLines:]
+	}
+	// Limit the redraw rate for chatty scripts.
+	if time.Since(p.lastDraw) >= 100*time.Millisecond {
+		p.draw()
+	}
+}
+
+// StartScript shows the script at the given index of the command list as
+// running. The display is paused for interactive scripts, which need the
+// terminal.
+func (p *Progress) StartScript(celist []*CmdEnv, i int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ce = celist[i]
+	p.step = i + 1
+	p.pending = celist[i:]
+	p.scriptT0 = time.Now()
+	p.tail = nil
+	p.paused = p.ce.flag&Einteractive != 0 && p.ce.answersFile == ""
+
+	if p.paused {
+		fmt.Fprintf(p.out, "%s (interactive)\n", p.status())
+		return
+	}
+	if !p.tty {
+		fmt.Fprintf(p.out, "%s\n", p.status())
+		return
+	}
+	p.draw()
+}
+
+// FinishScript prints the outcome of the running script.
+func (p *Progress) FinishScript(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ce == nil {
+		return
+	}
+	p.clear()
+	result := "done"
+	if err != nil {
+		result = "failed"
+	}
+	fmt.Fprintf(p.out, "[%d/%d] %s %s in %s\n", p.step,
+		p.step+len(p.pending)-1, p.name(), result,
+		formatDuration(time.Since(p.scriptT0)))
+	p.ce = nil
+	p.tail = nil
+	p.paused = false
+}
+
+// Finish stops the display, and prints the outcome of the build.
+func (p *Progress) Finish(err error) {
+	if p == nil {
+		return
+	}
+	if p.tty {
+		Std.RemoveFuncOutputs()
+		consoleOut = p.out
+		close(p.stop)
+		<-p.stopped
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	if err != nil {
+		fmt.Fprintf(p.out, "Build failed after %s.\n",
+			formatDuration(time.Since(p.start)))
+	} else {
+		fmt.Fprintf(p.out, "Build succeeded in %s.\n",
+			formatDuration(time.Since(p.start)))
+	}
+}
+
+// name returns the name of the running script, with its flags.
+func (p *Progress) name() string {
+	if flags := p.ce.FlagString(); flags != "" {
+		return fmt.Sprintf("%s [%s]", p.ce.name, flags)
+	}
+	return p.ce.name
+}
+
+// status returns the status line of the running script.
+func (p *Progress) status() string {
+	s := fmt.Sprintf("[%d/%d] %s, %s", p.step,
+		p.step+len(p.pending)-1, p.name(),
+		formatDuration(time.Since(p.start)))
+	eta, known := p.remaining()
+	switch {
+	case known == 0:
+	case known < len(p.pending):
+		s += fmt.Sprintf(", at least %s left", formatDuration(eta))
+	default:
+		s += fmt.Sprintf(", about %s left", formatDuration(eta))
+	}
+	return s
+}
+
+// remaining estimates the remaining build time from earlier durations of the
+// running and pending scripts, and returns the number of scripts it is based
+// on. Scripts that have not run before are left out, making the estimate
+// partial.
+func (p *Progress) remaining() (eta time.Duration, known int) {
+	for i, ce := range p.pending {
+		d, ok := p.durations[ce.name]
+		if !ok {
+			continue
+		}
+		known++
+		if i == 0 {
+			d -= time.Since(p.scriptT0)
+			if d < 0 {
+				d = 0
+			}
+		}
+		eta += d
+	}
+	return eta, known
+}
+
+// draw redraws the status line and the tail region.
+func (p *Progress) draw() {
+	if !p.tty || p.paused || p.ce == nil {
+		return
+	}
+	width := 80
+	if cols, _, err := getPtySize(p.out); err == nil && cols > 0 {
+		width = cols
+	}
+
+	lines := []string{p.status()}
+	for _, l := range p.tail {
+		lines = append(lines, "  "+l)
+	}
+	var b strings.Builder
+	b.WriteString(p.clearSeq())
+	for _, l := range lines {
+		b.WriteString(fitLine(l, width-1))
+		b.WriteString("\n")
+	}
+	io.WriteString(p.out, b.String())
+	p.drawn = len(lines)
+	p.lastDraw = time.Now()
+}
+
+// clear erases the status line and the tail region.
+func (p *Progress) clear() {
+	if p.tty {
+		io.WriteString(p.out, p.clearSeq())
+		p.drawn = 0
+	}
+}
+
+// clearSeq returns the terminal sequence to move to the start of the drawn
+// region, and erase it.
+func (p *Progress) clearSeq() string {
+	if p.drawn == 0 {
+		return "\r\x1b[J"
+	}
+	return fmt.Sprintf("\x1b[%dA\r\x1b[J", p.drawn)
+}
+
+// fitLine makes a line printable on a terminal of the given width, dropping
+// control characters and truncating it.
+func fitLine(s string, width int) string {
+	var runes []rune
+	for _, r := range normalizeTermLine(s) {
+		if r >= ' ' && r != 0x7f {
+			runes = append(runes, r)
+		}
+	}
+	if width > 0 && len(runes) > width {
+		runes = append(runes[:width-1], '…')
+	}
+	return string(runes)
+}
+
+// formatDuration formats a duration for the progress display, like "1m23s".
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFitLine(t *testing.T) {
+	tests := []struct {
+		in    string
+		width int
+		want  string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"much too long", 10, "much too …"},
+		{"tab\there\x1b[1mbold", 20, "tabherebold"},
+		{"progress 10%\rprogress 99%", 20, "progress 99%"},
+	}
+	for _, test := range tests {
+		if got := fitLine(test.in, test.width); got != test.want {
+			t.Errorf("fitLine(%q, %d): got %q, want %q", test.in,
+				test.width, got, test.want)
+		}
+	}
+}
+
+func TestProgressRemaining(t *testing.T) {
+	p := &Progress{
+		durations: map[string]time.Duration{
+			"10--a": 10 * time.Second,
+			"20--b": 20 * time.Second,
+		},
+		scriptT0: time.Now().Add(-4 * time.Second),
+	}
+	p.pending = []*CmdEnv{{name: "10--a"}, {name: "20--b"}}
+	eta, known := p.remaining()
+	if known != 2 || eta < 25*time.Second || eta > 26*time.Second {
+		t.Errorf("remaining: got %s for %d scripts, want about 26s "+
+			"for 2", eta, known)
+	}
+
+	// Unknown scripts are left out.
+	p.pending = append(p.pending, &CmdEnv{name: "30--new"})
+	eta, known = p.remaining()
+	if known != 2 || eta < 25*time.Second || eta > 26*time.Second {
+		t.Errorf("remaining: got %s for %d scripts, want about 26s "+
+			"for 2", eta, known)
+	}
+}
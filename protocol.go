@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+)
+
+// Separator between the fields of a child data record.
+const childDataSep = '\x1f'
+
+// Maximum size of a child data record or control message.
+const childDataMaxSize = 1024 * 1024
+
+// File descriptor of the JSON control channel in the command, and the
+// version of its protocol.
+const (
+	controlFd      = 4
+	controlVersion = 1
+)
+
+// Valid environment variable names.
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Child data categories, and whether their key is an environment variable
+// name.
+var childDataCategories = map[string]bool{
+	"setenv":     true,
+	"unsetenv":   true,
+	"log":        false,
+	"artifact":   false,
+	"appendenv":  true,
+	"prependenv": true,
+	"envsep":     true,
+	"setsecret":  true,
+	"fact":       false,
+	"addscript":  false,
+}
+
+// parseChildData parses and validates a child data record on the form
+// "category \x1f key \x1f value". The value may contain separators.
+func parseChildData(record []byte) (*ChildData, error) {
+	r := bytes.SplitN(record, []byte{childDataSep}, 3)
+	if len(r) != 3 {
+		return nil, fmt.Errorf("record %q has %d fields, want 3",
+			truncate(record, 64), len(r))
+	}
+	cd := &ChildData{
+		category: string(r[0]),
+		key:      string(r[1]),
+		value:    string(r[2]),
+	}
+	if err := validateChildData(cd); err != nil {
+		return nil, err
+	}
+	return cd, nil
+}
+
+// unknownCategoryError is returned for child data with an unknown category,
+// which is only a protocol error in strict mode.
+type unknownCategoryError string
+
+func (e unknownCategoryError) Error() string {
+	return fmt.Sprintf("unknown category %q", string(e))
+}
+
+// validateChildData checks the category and key of child data.
+func validateChildData(cd *ChildData) error {
+	envKey, ok := childDataCategories[cd.category]
+	if !ok {
+		return unknownCategoryError(cd.category)
+	}
+	if envKey && !envKeyRe.MatchString(cd.key) {
+		return fmt.Errorf("invalid environment variable name %q",
+			cd.key)
+	}
+	if cd.category == "log" && ctlLogLevels[cd.key] == nil {
+		return fmt.Errorf("invalid log level %q", cd.key)
+	}
+	if cd.category == "envsep" && cd.value == "" {
+		return errors.New("empty list separator")
+	}
+	if cd.category == "fact" && !factKeyRe.MatchString(cd.key) {
+		return fmt.Errorf("invalid fact name %q", cd.key)
+	}
+	if cd.category == "addscript" && cd.value == "" {
+		return errors.New("missing script path")
+	}
+	if cd.category == "artifact" {
+		if !artifactKindRe.MatchString(cd.key) {
+			return fmt.Errorf("invalid artifact kind %q", cd.key)
+		}
+		if cd.value == "" {
+			return errors.New("missing artifact path")
+		}
+	}
+	return nil
+}
+
+// A controlMessage is a message on the JSON control channel. The type is a
+// child data category. Unknown fields are ignored, so that messages can be
+// extended without a new protocol version.
+type controlMessage struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Sep     string `json:"sep"`
+}
+
+// parseControlMessage parses and validates a JSON control message.
+func parseControlMessage(line []byte) (*ChildData, error) {
+	var m controlMessage
+	if err := json.Unmarshal(line, &m); err != nil {
+		return nil, err
+	}
+	if m.Version == 0 {
+		return nil, errors.New("missing protocol version")
+	}
+	if m.Version > controlVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d",
+			m.Version)
+	}
+	cd := &ChildData{
+		category: m.Type,
+		key:      m.Key,
+		value:    m.Value,
+		sep:      m.Sep,
+	}
+	if err := validateChildData(cd); err != nil {
+		return nil, err
+	}
+	return cd, nil
+}
+
+// protocolError reports a malformed record or message. Unknown categories
+// are only warned about, unless in strict mode. In strict mode, the
+// first protocol error is kept, to fail the command once it has finished.
+func (ce *CmdEnv) protocolError(channel string, offset int64, err error) {
+	ce.childDataMu.Lock()
+	defer ce.childDataMu.Unlock()
+	if _, ok := err.(unknownCategoryError); ok && !ce.strictProtocol {
+		Warningf("Ignoring record from '%s' (%s, byte %d): %s",
+			ce.name, channel, offset, err)
+		return
+	}
+	Errorf("Protocol error in '%s' (%s, byte %d): %s",
+		ce.name, channel, offset, err)
+	if ce.strictProtocol && ce.protocolErr == nil {
+		ce.protocolErr = fmt.Errorf("protocol error (%s, byte %d): %s",
+			channel, offset, err)
+	}
+}
+
+// dispatchChildData hands child data over to the childDataHandler function
+// of the command environment. Both channels may deliver data at the same
+// time, so calls are serialized.
+func (ce *CmdEnv) dispatchChildData(cd *ChildData) {
+	ce.childDataMu.Lock()
+	defer ce.childDataMu.Unlock()
+	if ce.childDataHandler == nil {
+		Warningf("Ignoring %s record from '%s'.", cd.category, ce.name)
+		return
+	}
+	ce.childDataHandler(ce, cd)
+	Tracef("Handled %s record from '%s': key=%q", cd.category, ce.name,
+		cd.key)
+}
+
+// truncate shortens a byte slice for use in messages.
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return append(b[:n:n], "..."...)
+	}
+	return b
+}
+
+// readChannel scans a child data channel, using the given split and parse
+// functions, and dispatches the data. Malformed records are reported with
+// their byte offset, and skipped.
+func readChannel(r io.Reader, ce *CmdEnv, channel string,
+	split bufio.SplitFunc, parse func([]byte) (*ChildData, error)) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), childDataMaxSize)
+	// Count the bytes consumed by the split function, since tokens do
+	// not include their terminator, which may be longer than one byte.
+	var offset, consumed int64
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		if token != nil {
+			offset = consumed
+		}
+		consumed += int64(advance)
+		return advance, token, err
+	})
+
+	for s.Scan() {
+		record := s.Bytes()
+		if len(bytes.TrimSpace(record)) > 0 {
+			if cd, err := parse(record); err != nil {
+				ce.protocolError(channel, offset, err)
+			} else {
+				ce.dispatchChildData(cd)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		ce.protocolError(channel, consumed, err)
+		// Keep reading, so that the command does not block on
+		// writing.
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+// readPipe reads the fd 3 record channel and the JSON control channel of a
+// command, until both are closed.
+func readPipe(pipe, control io.Reader, ce *CmdEnv, stop chan bool) {
+	done := make(chan bool)
+	go func() {
+		readChannel(control, ce, "control channel", bufio.ScanLines,
+			parseControlMessage)
+		done <- true
+	}()
+	readChannel(pipe, ce, "fd 3", scanNull, parseChildData)
+	<-done
+	stop <- true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseChildData(t *testing.T) {
+	for _, tc := range []struct {
+		in                   string
+		category, key, value string
+	}{
+		{"setenv\x1fFOO\x1fbar", "setenv", "FOO", "bar"},
+		{"setenv\x1f_x1\x1fa\x1fb", "setenv", "_x1", "a\x1fb"},
+		{"unsetenv\x1fFOO\x1f", "unsetenv", "FOO", ""},
+	} {
+		cd, err := parseChildData([]byte(tc.in))
+		if err != nil {
+			t.Fatalf("parseChildData(%q) failed: %s", tc.in, err)
+		}
+		if cd.category != tc.category || cd.key != tc.key ||
+			cd.value != tc.value {
+			t.Fatalf("parseChildData(%q): got %+v", tc.in, cd)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"setenv",
+		"setenv\x1fFOO",
+		"unsetenv\x1fFOO",
+		"setnev\x1fFOO\x1fbar",
+		"setenv\x1f\x1fbar",
+		"setenv\x1f1FOO\x1fbar",
+		"setenv\x1fFOO BAR\x1fbar",
+		"setenv\x1fFOO=x\x1fbar",
+	} {
+		if _, err := parseChildData([]byte(in)); err == nil {
+			t.Fatalf("parseChildData(%q) did not fail.", in)
+		}
+	}
+}
+
+func TestParseControlMessage(t *testing.T) {
+	in := `{"v":1,"type":"setenv","key":"FOO","value":"a b","future":true}`
+	cd, err := parseControlMessage([]byte(in))
+	if err != nil {
+		t.Fatalf("parseControlMessage(%s) failed: %s", in, err)
+	}
+	if cd.category != "setenv" || cd.key != "FOO" || cd.value != "a b" {
+		t.Fatalf("parseControlMessage(%s): got %+v", in, cd)
+	}
+
+	for _, in := range []string{
+		`setenv FOO bar`,
+		`{"type":"setenv","key":"FOO","value":"bar"}`,
+		`{"v":2,"type":"setenv","key":"FOO","value":"bar"}`,
+		`{"v":1,"type":"nope","key":"FOO"}`,
+		`{"v":1,"type":"unsetenv","key":"1FOO"}`,
+		`{"v":"1","type":"unsetenv","key":"FOO"}`,
+	} {
+		if _, err := parseControlMessage([]byte(in)); err == nil {
+			t.Fatalf("parseControlMessage(%s) did not fail.", in)
+		}
+	}
+}
+
+func TestReadChannel(t *testing.T) {
+	var got []string
+	ce := &CmdEnv{
+		name:           "test",
+		strictProtocol: true,
+		childDataHandler: func(ce *CmdEnv, cd *ChildData) {
+			got = append(got, cd.key)
+		},
+	}
+	msg := `{"v":1,"type":"setenv","key":"FOO","value":"bar"}`
+	in := msg + "\r\n\r\nbad\r\n" + msg + "\n"
+	readChannel(strings.NewReader(in), ce, "control channel",
+		bufio.ScanLines, parseControlMessage)
+	if len(got) != 2 {
+		t.Fatalf("Handled %v, want two records", got)
+	}
+	want := fmt.Sprintf("byte %d)", len(msg)+4)
+	if ce.protocolErr == nil ||
+		!strings.Contains(ce.protocolErr.Error(), want) {
+		t.Fatalf("Got protocol error %v, want offset '%s'",
+			ce.protocolErr, want)
+	}
+
+	// Unknown categories are only an error in strict mode.
+	ce = &CmdEnv{name: "test"}
+	readChannel(strings.NewReader("nope\x1fFOO\x1fbar\x00"), ce, "fd 3",
+		scanNull, parseChildData)
+	ce.strictProtocol = true
+	if ce.protocolErr != nil {
+		t.Fatalf("Unknown category failed outside strict mode: %s",
+			ce.protocolErr)
+	}
+	readChannel(strings.NewReader("nope\x1fFOO\x1fbar\x00"), ce, "fd 3",
+		scanNull, parseChildData)
+	if ce.protocolErr == nil {
+		t.Fatalf("Unknown category passed in strict mode.")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Default pseudo-terminal size.
+const (
+	defaultPtyCols = 80
+	defaultPtyRows = 24
+)
+
+// Terminal escape sequences: CSI, OSC and other escape sequences.
+var ansiEscapeRe = regexp.MustCompile(
+	"\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)?|\x1b[ -/]*[0-~]")
+
+// ioctl performs an ioctl system call with a pointer argument.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req,
+		uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenPty allocates a pseudo-terminal, returning its master and slave ends.
+func OpenPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Unlock the slave and look up its number.
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK,
+		unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlockpt: %s", err)
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("ptsname: %s", err)
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n),
+		os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// SetPtySize sets the window size of a pseudo-terminal.
+func SetPtySize(f *os.File, cols, rows int) error {
+	ws := struct {
+		rows, cols, xpixel, ypixel uint16
+	}{uint16(rows), uint16(cols), 0, 0}
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// parsePtySize parses a terminal size on the form "COLSxROWS".
+func parsePtySize(s string) (cols, rows int, err error) {
+	parts := strings.Split(s, "x")
+	if len(parts) == 2 {
+		cols, err = strconv.Atoi(parts[0])
+		if err == nil {
+			rows, err = strconv.Atoi(parts[1])
+		}
+		if err == nil && cols > 0 && rows > 0 &&
+			cols <= 0xffff && rows <= 0xffff {
+			return cols, rows, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid pty size %q; want COLSxROWS", s)
+}
+
+// normalizeTermLine turns a line of terminal output into plain text. Escape
+// sequences are removed, and carriage returns are treated like a terminal
+// would, so only the last state of a progress bar is kept.
+func normalizeTermLine(line string) string {
+	line = ansiEscapeRe.ReplaceAllString(line, "")
+	line = strings.TrimRight(line, "\r")
+	if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+		// Overwrite the start of the line with the text after the
+		// last carriage return.
+		last := line[i+1:]
+		prev := normalizeTermLine(line[:i])
+		if len(prev) > len(last) {
+			last += prev[len(last):]
+		}
+		line = last
+	}
+	return line
+}
+
+// readPty logs the output of a pseudo-terminal line by line with the given
+// function, until the slave end is closed by all processes.
+func readPty(r io.Reader, prefix string,
+	logf func(format string, v ...interface{}), stop chan bool) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			logf("%s %s", prefix,
+				normalizeTermLine(strings.TrimSuffix(line, "\n")))
+		}
+		if err != nil {
+			// Reading the master returns EIO once the slave
+			// is closed.
+			if err != io.EOF && !isEIO(err) {
+				Errorf("pty read error: %s", err)
+			}
+			break
+		}
+	}
+	stop <- true
+}
+
+// isEIO reports whether the error is an I/O error from the kernel.
+func isEIO(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EIO
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeTermLine(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"plain", "plain"},
+		{"line\r", "line"},
+		{"\x1b[1;31mred\x1b[0m", "red"},
+		{"\x1b]0;title\x07text", "text"},
+		{"\x1b(Bascii", "ascii"},
+		{"10%\r50%\r100%", "100%"},
+		{"abcdef\rxy", "xycdef"},
+		{"\x1b[2K\rDone.\r", "Done."},
+	} {
+		if got := normalizeTermLine(tc.in); got != tc.want {
+			t.Fatalf("normalizeTermLine(%q): got %q, want %q",
+				tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParsePtySize(t *testing.T) {
+	cols, rows, err := parsePtySize("132x43")
+	if err != nil || cols != 132 || rows != 43 {
+		t.Fatalf("parsePtySize(132x43): got %d, %d, %v", cols, rows, err)
+	}
+	for _, s := range []string{"", "80", "80x", "x24", "0x24", "80x24x1", "80x70000"} {
+		if _, _, err := parsePtySize(s); err == nil {
+			t.Fatalf("parsePtySize(%q) did not fail.", s)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// getTermios reads the terminal attributes of a file.
+func getTermios(f *os.File) (*syscall.Termios, error) {
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// setTermios sets the terminal attributes of a file.
+func setTermios(f *os.File, t *syscall.Termios) error {
+	return ioctl(f, syscall.TCSETS, unsafe.Pointer(t))
+}
+
+// IsTerminal reports whether the file is a terminal.
+func IsTerminal(f *os.File) bool {
+	if f == nil {
+		return false
+	}
+	_, err := getTermios(f)
+	return err == nil
+}
+
+// makeRaw puts a terminal into raw mode, like cfmakeraw(3), and returns its
+// previous attributes.
+func makeRaw(f *os.File) (*syscall.Termios, error) {
+	old, err := getTermios(f)
+	if err != nil {
+		return nil, err
+	}
+	t := *old
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
+		syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL |
+		syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON |
+		syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := setTermios(f, &t); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// getPtySize reads the window size of a terminal.
+func getPtySize(f *os.File) (cols, rows int, err error) {
+	var ws struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+	if err := ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return 0, 0, err
+	}
+	return int(ws.cols), int(ws.rows), nil
+}
+
+// A transcriptWriter splits terminal output into lines, and logs them with
+// the given function. Input echoed by the terminal can be left out on a
+// best-effort basis: typed bytes are queued, and dropped when they come back
+// as output.
+type transcriptWriter struct {
+	prefix string
+	logf   func(format string, v ...interface{})
+	line   []byte
+	echo   []byte
+	mu     sync.Mutex
+}
+
+// Typed queues input expected to be echoed back by the terminal.
+func (tw *transcriptWriter) Typed(p []byte) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, b := range p {
+		if b == '\r' {
+			// A typed return is echoed as a line break.
+			tw.echo = append(tw.echo, '\r', '\n')
+			continue
+		}
+		tw.echo = append(tw.echo, b)
+	}
+}
+
+func (tw *transcriptWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, b := range p {
+		if len(tw.echo) > 0 {
+			if b == tw.echo[0] {
+				tw.echo = tw.echo[1:]
+				if b == '\n' {
+					tw.flush()
+				}
+				continue
+			}
+			// Not an echo after all; stop filtering.
+			tw.echo = nil
+		}
+		if b == '\n' {
+			tw.flush()
+			continue
+		}
+		tw.line = append(tw.line, b)
+	}
+	return len(p), nil
+}
+
+// flush logs the pending line, if any.
+func (tw *transcriptWriter) flush() {
+	if len(tw.line) == 0 {
+		return
+	}
+	tw.logf("%s %s", tw.prefix, normalizeTermLine(string(tw.line)))
+	tw.line = tw.line[:0]
+}
+
+// Close logs any unterminated last line.
+func (tw *transcriptWriter) Close() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.flush()
+	return nil
+}
+
+// proxyPty connects the user's terminal to the pseudo-terminal of an
+// interactive command. Input is passed through in raw mode, window size
+// changes are forwarded, and the output is shown to the user as well as
+// logged to the transcript. Typed input is left out of the transcript if
+// hideInput is set. It returns when the command has closed the terminal.
+func proxyPty(master *os.File, hideInput bool) error {
+	tw := &transcriptWriter{prefix: "[tty]", logf: Transcriptf}
+	defer tw.Close()
+
+	// Follow the size of the user's terminal.
+	resize := func() {
+		if cols, rows, err := getPtySize(os.Stdin); err == nil {
+			SetPtySize(master, cols, rows)
+		}
+	}
+	resize()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	go func() {
+		for range winch {
+			resize()
+		}
+	}()
+
+	old, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer setTermios(os.Stdin, old)
+
+	// Read input from a non-blocking duplicate of stdin, so that the
+	// read can be interrupted once the command is done, instead of
+	// swallowing the user's next keystroke.
+	fd, err := syscall.Dup(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	defer syscall.SetNonblock(int(os.Stdin.Fd()), false)
+	in := os.NewFile(uintptr(fd), "stdin")
+	defer in.Close()
+
+	inputDone := make(chan bool)
+	go func() {
+		defer close(inputDone)
+		buf := make([]byte, 1024)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				// Only queue echo filtering when the terminal
+				// actually echoes, not at password prompts.
+				if hideInput {
+					if t, err := getTermios(master); err == nil &&
+						t.Lflag&syscall.ECHO != 0 {
+						tw.Typed(buf[:n])
+					}
+				}
+				if _, err := master.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err = io.Copy(io.MultiWriter(os.Stdout, tw), master)
+	if isEIO(err) {
+		// Reading the master returns EIO once the slave is closed.
+		err = nil
+	}
+
+	in.SetReadDeadline(time.Now())
+	<-inputDone
+	return err
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -45,21 +48,120 @@ func cmdInit(workDir string) error {
 	return nil
 }
 
-func handleChildData(cd *ChildData) {
+func handleChildData(ce *CmdEnv, cd *ChildData) {
 	switch {
 	case cd.category == "setenv":
 		// Add to the persistent command environment.
 		cmdPersistEnv[cd.key] = cd.value
+		delete(cmdPersistLists, cd.key)
 	case cd.category == "unsetenv":
 		// Remove from the persistent command environment.
 		delete(cmdPersistEnv, cd.key)
+		delete(cmdPersistLists, cd.key)
+	case cd.category == "appendenv" || cd.category == "prependenv":
+		// Extend a list in the persistent command environment.
+		l := persistList(cd.key)
+		if cd.sep != "" {
+			if err := l.SetSep(cd.sep); err != nil {
+				Errorf("Ignoring %s of '%s' from '%s': %s",
+					cd.category, cd.key, ce.name, err)
+				return
+			}
+		}
+		if cd.category == "appendenv" {
+			l.Append(cd.value)
+		} else {
+			l.Prepend(cd.value)
+		}
+	case cd.category == "setsecret":
+		// Add to the persistent command environment, masked in
+		// all log output.
+		setSecret(cd.key, cd.value)
+	case cd.category == "envsep":
+		// Set the list separator of a variable.
+		if err := persistList(cd.key).SetSep(cd.value); err != nil {
+			Errorf("Ignoring envsep of '%s' from '%s': %s", cd.key,
+				ce.name, err)
+		}
+	case cd.category == "log":
+		// Log a message on behalf of the command.
+		ctlLogLevels[cd.key]("[log] %s", cd.value)
+	case cd.category == "artifact":
+		// Record once the command has finished.
+		ce.artifacts = append(ce.artifacts,
+			pendingArtifact{kind: cd.key, path: cd.value})
+	case cd.category == "fact":
+		// Saved once the command has finished.
+		buildFacts.Set(cd.key, cd.value, ce.name)
+	case cd.category == "addscript":
+		// Added to the pending commands once the command has
+		// finished.
+		ce.scripts = append(ce.scripts, cd.value)
+	}
+}
+
+// checkUnanswered fails if any of the commands are interactive scripts
+// without an answer file.
+func checkUnanswered(celist []*CmdEnv) error {
+	var unanswered []string
+	for _, ce := range celist {
+		if ce.flag&Einteractive != 0 && ce.answersFile == "" {
+			unanswered = append(unanswered, ce.name)
+		}
+	}
+	if len(unanswered) > 0 {
+		Errorf("Interactive scripts without answer file: %s",
+			strings.Join(unanswered, ", "))
+		return errors.New("interactive scripts in non-interactive build")
+	}
+	return nil
+}
+
+// Options for the build command.
+type buildOptions struct {
+	seqmin             int
+	arch               string
+	fakerootSession    bool
+	fakerootCheckpoint time.Duration
+	dryRun             bool
+	answers            map[string]string
+	nonInteractive     bool
+	strictProtocol     bool
+	secrets            string
+	keepBuilds         int
+	maxLogAge          time.Duration
+	progress           string
+	tailLines          int
+	report             io.Writer
+}
+
+// saveFakerootState persists the fakeroot state after a fakeroot-wrapped
+// command, once the checkpoint interval has passed since it was last saved:
+// the shared faked session, if any, saves its database, and the path sidecar
+// file is updated. It is saved again when the build ends. Only a failed
+// faked checkpoint is an error, as the session is then gone.
+func saveFakerootState(workDir string, faked *FakedSession,
+	interval time.Duration, saved *time.Time) error {
+	if time.Since(*saved) < interval {
+		return nil
+	}
+	if faked != nil {
+		if err := faked.Checkpoint(); err != nil {
+			Errorf("Faked checkpoint failed: %s", err)
+			return fmt.Errorf("faked checkpoint: %s", err)
+		}
+	}
+	if err := WriteFakerootPaths(workDir); err != nil {
+		Warningf("WriteFakerootPaths: %s", err)
 	}
+	*saved = time.Now()
+	return nil
 }
 
-func cmdBuild(workDir string, seqmin int) error {
+func cmdBuild(workDir string, opts *buildOptions) (buildErr error) {
 	workDir, err := RealPath(workDir)
 	if err != nil {
-		Errorf("RealPath: %s")
+		Errorf("RealPath: %s", err)
 		return err
 	}
 
@@ -73,25 +175,73 @@ func cmdBuild(workDir string, seqmin int) error {
 		return err
 	}
 
-	// Open log file.
-	f, err := os.OpenFile(
-		filepath.Join(workDir, PATHNAME_LOG, "build.log"),
-		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-		0600)
+	// Start timer.
+	t0 := time.Now()
+
+	// Open the log files of this build, and remove old ones.
+	bl, err := OpenBuildLog(workDir, t0)
 	if err != nil {
 		return err
 	}
-	AddLoggerOutput(f)
+	defer bl.Close()
+	defer func() { bl.Finish(buildErr) }()
+	if opts.dryRun {
+		bl.SetDryRun()
+	}
+
+	// Show the progress, estimating from earlier builds.
+	progress := NewProgress(opts.progress,
+		PreviousDurations(workDir, bl.id))
+	defer func() { progress.Finish(buildErr) }()
+	if err := PruneBuildLogs(workDir, opts.keepBuilds, opts.maxLogAge,
+		bl.id); err != nil {
+		Warningf("PruneBuildLogs: %s", err)
+	}
+
+	// Determine the target architecture: the one given, or else that
+	// of the rootfs, falling back to the host architecture.
+	arch := opts.arch
+	if arch != "" {
+		a := LookupArch(arch)
+		if a == nil {
+			Errorf("Unknown architecture '%s'.", arch)
+			return errors.New("unknown architecture")
+		}
+		arch = a.name
+	} else {
+		a, err := RootfsArch(filepath.Join(workDir, PATHNAME_ROOTFS))
+		if err != nil {
+			Warningf("RootfsArch: %s", err)
+		}
+		if a == nil {
+			a = HostArch()
+		}
+		if a != nil {
+			arch = a.name
+		}
+	}
+	Debugf("Target architecture: %s", arch)
 
 	// Initialize the persistent command environment.
 	cmdPersistEnv = make(map[string]string)
+	cmdPersistLists = make(map[string]*envList)
+	if opts.secrets != "" {
+		if err := LoadSecrets(workDir, opts.secrets); err != nil {
+			Errorf("LoadSecrets: %s", err)
+			return err
+		}
+	}
 
-	// Start timer.
-	t0 := time.Now()
+	// Read the work directory configuration.
+	config, err := ReadConfig(filepath.Join(workDir, PATHNAME_CONFIG))
+	if err != nil {
+		Errorf("ReadConfig: %s", err)
+		return err
+	}
 
 	// Prepare execution parts.
 	celist, err := PrepareParts(filepath.Join(workDir, PATHNAME_BUILDD),
-		seqmin)
+		opts.seqmin, config)
 	if err != nil {
 		Infof("PrepareParts: %s", err)
 		return err
@@ -103,19 +253,164 @@ func cmdBuild(workDir string, seqmin int) error {
 		return nil
 	}
 
+	// Apply answer files given on the command line.
+	for name, pathname := range opts.answers {
+		var found *CmdEnv
+		for _, ce := range celist {
+			if ce.name == name {
+				found = ce
+			}
+		}
+		if found == nil {
+			Errorf("No build script named '%s' for answer file.", name)
+			return errors.New("unknown build script")
+		}
+		if err := found.SetAnswers(pathname); err != nil {
+			Errorf("SetAnswers: %s", err)
+			return err
+		}
+	}
+
+	// Refuse to wait for user input in an unattended build.
+	if opts.nonInteractive {
+		if err := checkUnanswered(celist); err != nil {
+			return err
+		}
+	}
+
+	// The shared faked session is started along with the first
+	// fakeroot-wrapped command. When the build ends, it is stopped, and
+	// the fakeroot state is saved.
+	var faked *FakedSession
+	var fakerootSaved time.Time
+	defer func() {
+		if fakerootSaved.IsZero() {
+			return
+		}
+		if faked != nil {
+			if err := faked.Stop(); err != nil {
+				Warningf("Stopping faked session: %s", err)
+			}
+		}
+		if err := WriteFakerootPaths(workDir); err != nil {
+			Warningf("WriteFakerootPaths: %s", err)
+		}
+	}()
+
+	// Artifacts of earlier builds remain in the manifest until replaced.
+	manifest, err := ReadArtifactManifest(workDir)
+	if err != nil {
+		Errorf("ReadArtifactManifest: %s", err)
+		return err
+	}
+
+	// Facts of earlier builds remain until replaced.
+	buildFacts, err = ReadFacts(workDir)
+	if err != nil {
+		Errorf("ReadFacts: %s", err)
+		return err
+	}
+
 	// Iterate over each command execution environment.
-	for _, ce := range celist {
+	var usage ResourceUsage
+	var dryRunErr error
+	// Scripts generated by a command are inserted into the list.
+	for i := 0; i < len(celist); i++ {
+		ce := celist[i]
 		ce.workDir = workDir
+		ce.arch = arch
 		ce.childDataHandler = handleChildData
+		ce.tailLines = opts.tailLines
+		if err := bl.StartScript(ce.name); err != nil {
+			Errorf("StartScript: %s", err)
+			return err
+		}
+		if opts.strictProtocol {
+			ce.strictProtocol = true
+		}
+
+		if opts.dryRun {
+			ce.dryRun = true
+			err := ce.RunCmd()
+			if err != nil {
+				Errorf("Dry run of '%s' failed: %s", ce.name, err)
+				dryRunErr = err
+			}
+			bl.FinishScript(err)
+			continue
+		}
 
-		if err := ce.RunCmd(); err != nil {
+		if ce.flag&Efakeroot != 0 && fakerootSaved.IsZero() {
+			if err := CheckFakerootState(workDir); err != nil {
+				Errorf("CheckFakerootState: %s", err)
+				return err
+			}
+			fakerootSaved = time.Now()
+			if opts.fakerootSession {
+				faked, err = StartFakedSession(filepath.Join(
+					workDir, PATHNAME_FAKEROOTSAVE))
+				if err != nil {
+					Errorf("StartFakedSession: %s", err)
+					return err
+				}
+			}
+		}
+		ce.faked = faked
+
+		progress.StartScript(celist, i)
+		err := ce.RunCmd()
+		if ce.usage != nil {
+			usage.Add(*ce.usage)
+		}
+		if err == nil && ce.flag&Efakeroot != 0 {
+			err = saveFakerootState(workDir, faked,
+				opts.fakerootCheckpoint, &fakerootSaved)
+		}
+		if err == nil && len(ce.artifacts) > 0 {
+			if err = ce.RecordArtifacts(manifest); err == nil {
+				err = manifest.Write(workDir)
+			}
+		}
+		if err == nil {
+			err = buildFacts.Write(workDir)
+		}
+		if err == nil && len(ce.scripts) > 0 {
+			var added []*CmdEnv
+			if added, err = ce.GeneratedParts(config); err == nil {
+				celist, err = insertParts(celist, i, added)
+			}
+			if err == nil && opts.nonInteractive {
+				err = checkUnanswered(added)
+			}
+		}
+		bl.FinishScript(err)
+		progress.FinishScript(err)
+		if err != nil {
 			Errorf("Command failed: %s", err)
+			ce.ReportFailure(opts.report, err,
+				bl.ScriptLogPath(ce.name))
+			Infof("Total resource usage: %s", usage)
 			return err
 		}
 	}
 
+	bl.EndScript()
+
+	if dryRunErr != nil {
+		return dryRunErr
+	}
+
 	t1 := time.Now()
 	Infof("Build duration: %s", t1.Sub(t0).String())
+	Infof("Total resource usage: %s", usage)
+	for _, a := range manifest.Artifacts {
+		Infof("Artifact: %s %s (%d bytes, sha256 %s, from '%s')",
+			a.Kind, a.Path, a.Size, a.SHA256, a.Script)
+	}
+	for _, key := range buildFacts.Keys() {
+		f := buildFacts.Facts[key]
+		Infof("Fact: %s=%s (from '%s')", key, f.Value, f.Script)
+	}
 
 	return nil
 }
@@ -123,7 +418,7 @@ func cmdBuild(workDir string, seqmin int) error {
 func cmdShell(workDir string, args []string) error {
 	workDir, err := RealPath(workDir)
 	if err != nil {
-		Errorf("RealPath: %s")
+		Errorf("RealPath: %s", err)
 		return err
 	}
 
@@ -133,6 +428,7 @@ func cmdShell(workDir string, args []string) error {
 	}
 
 	ce := &CmdEnv{
+		name:    "shell",
 		workDir: workDir,
 		chrootDir: filepath.Join(
 			workDir, PATHNAME_ROOTFS),
@@ -145,6 +441,16 @@ func cmdShell(workDir string, args []string) error {
 		Efakeroot |
 		Efakechroot
 
+	config, err := ReadConfig(filepath.Join(workDir, PATHNAME_CONFIG))
+	if err != nil {
+		Errorf("ReadConfig: %s", err)
+		return err
+	}
+	if err := ce.ApplyDirectives(config); err != nil {
+		Errorf("Invalid configuration: %s", err)
+		return err
+	}
+
 	if len(args) > 0 {
 		ce.Path = args[0]
 		ce.Args = args
@@ -181,9 +487,16 @@ func cmdShell(workDir string, args []string) error {
 			"-i",
 		}
 	}
+	if err := CheckFakerootState(workDir); err != nil {
+		Errorf("CheckFakerootState: %s", err)
+		return err
+	}
 	if err := ce.RunCmd(); err != nil {
 		Infof("ce.RunCmd: %s", err)
 	}
+	if err := WriteFakerootPaths(workDir); err != nil {
+		Warningf("WriteFakerootPaths: %s", err)
+	}
 
 	return nil
 }
@@ -191,7 +504,7 @@ func cmdShell(workDir string, args []string) error {
 func cmdClean(workDir string, all bool) error {
 	workDir, err := RealPath(workDir)
 	if err != nil {
-		Errorf("RealPath: %s")
+		Errorf("RealPath: %s", err)
 		return err
 	}
 
@@ -205,6 +518,8 @@ func cmdClean(workDir string, all bool) error {
 		PATHNAME_ROOTFS,
 		PATHNAME_TMP,
 		PATHNAME_FAKEROOTSAVE,
+		PATHNAME_FAKEROOTPATHS,
+		PATHNAME_FACTS,
 	}
 
 	if all {
@@ -236,24 +551,131 @@ func cmdClean(workDir string, all bool) error {
 func main() {
 	// Kingpin configuration.
 	var (
-		app     = kingpin.New("rib", "Root Image Build tool.")
-		verbose = app.Flag("verbose", "Enable verbose output.").Short('v').Counter()
-		quiet   = app.Flag("quiet", "Enable quiet output.").Short('q').Bool()
-		dir     = app.Flag("dir", "Work directory.").Default(".").Short('d').String()
+		app      = kingpin.New("rib", "Root Image Build tool.")
+		verbose  = app.Flag("verbose", "Enable verbose output.").Short('v').Counter()
+		quiet    = app.Flag("quiet", "Enable quiet output.").Short('q').Bool()
+		loglevel = app.Flag("log-level", "Console log level: trace, debug, info, warning or error.").String()
+		dir      = app.Flag("dir", "Work directory.").Default(".").Short('d').String()
 
 		init    = app.Command("init", "Create empty rib directory.")
 		initdir = init.Arg("workdir", "Work directory.").String()
 
-		build    = app.Command("build", "Run build scripts.")
-		buildseq = build.Flag("buildseq", "Minimum sequence number.").Short('s').Default("0").Int()
+		build           = app.Command("build", "Run build scripts.")
+		buildseq        = build.Flag("buildseq", "Minimum sequence number.").Short('s').Default("0").Int()
+		buildarch       = build.Flag("arch", "Target architecture.").String()
+		buildfaked      = build.Flag("fakeroot-session", "Share one faked daemon across scripts.").Default("true").Bool()
+		buildcheckpoint = build.Flag("fakeroot-checkpoint", "Interval between faked state saves.").Default("1m").Duration()
+		builddryrun     = build.Flag("dry-run", "Show what would be executed.").Short('n').Bool()
+		buildanswers    = build.Flag("answers", "Answer file for an interactive script, as NAME=PATH.").StringMap()
+		buildnonint     = build.Flag("non-interactive", "Refuse to run interactive scripts without answer file.").Bool()
+		buildstrict     = build.Flag("strict-protocol", "Fail scripts on protocol errors.").Bool()
+		buildkeep       = build.Flag("keep-builds", "Number of build logs to keep, or 0 for all.").Default("20").Int()
+		buildmaxage     = build.Flag("max-log-age", "Maximum age of build logs, or 0 for no limit.").Default("0").Duration()
+		buildprogress   = build.Flag("progress", "Progress display: auto, tty, plain or none.").Default(progressAuto).Enum(progressAuto, progressTTY, progressPlain, progressNone)
+		buildtail       = build.Flag("tail-lines", "Number of output lines to show for a failed script.").Default(strconv.Itoa(defaultTailLines)).Int()
+		buildsecrets    = build.Flag("secrets", "File of secret KEY=VALUE variables, outside the work directory.").String()
 
 		shell     = app.Command("shell", "Run build scripts.")
 		shellargs = shell.Arg("shellargs", "Command args.").Strings()
 
 		clean    = app.Command("clean", "Clean rootfs, tmp and fakeroot.save.")
 		cleanall = clean.Flag("all", "Also clean dist and log directories.").Short('a').Bool()
+
+		logc      = app.Command("log", "Browse the logs of past builds.")
+		logls     = logc.Command("ls", "List past builds.").Default()
+		logshow   = logc.Command("show", "Show the log of a build.")
+		logbuild  = logshow.Arg("build", "Build ID or unique prefix, or latest.").Default("latest").String()
+		logscript = logshow.Flag("script", "Only show messages of this script.").Short('s').String()
+		loglvl    = logshow.Flag("level", "Minimum level: trace, debug, info, warning or error.").Short('l').Default("debug").String()
+		logstream = logshow.Flag("stream", "Only show this stream: stdout, stderr, pty, tty or log.").Enum("stdout", "stderr", "pty", "tty", "log")
+		logfollow = logshow.Flag("follow", "Follow a running build.").Short('f').Bool()
+
+		facts    = app.Command("facts", "Show facts recorded by build scripts.")
+		factskey = facts.Arg("key", "Fact name.").String()
+
+		fakeroot       = app.Command("fakeroot", "Inspect and edit fakeroot.save.")
+		fakerootls     = fakeroot.Command("ls", "List recorded ownership and modes.")
+		fakerootverify = fakeroot.Command("verify", "Report stale entries.")
+		fakerootset    = fakeroot.Command("set", "Set owner or mode of a rootfs path.")
+		fakerootpath   = fakerootset.Arg("path", "Path inside rootfs.").Required().String()
+		fakerootowner  = fakerootset.Flag("owner", "Owner, as user[:group].").Short('o').String()
+		fakerootmode   = fakerootset.Flag("mode", "Octal permission bits.").Short('m').String()
+
+		ctl         = app.Command("ctl", "Send control messages from a build script.")
+		ctlsetenv   = ctl.Command("setenv", "Set a variable for later scripts.")
+		ctlsetkey   = ctlsetenv.Arg("key", "Variable name.").Required().String()
+		ctlsetvalue = ctlsetenv.Arg("value", "Variable value.").Required().String()
+		ctlunsetenv = ctl.Command("unsetenv", "Unset a variable for later scripts.")
+		ctlunsetkey = ctlunsetenv.Arg("key", "Variable name.").Required().String()
+		ctllog      = ctl.Command("log", "Log a message in the build log.")
+		ctlloglevel = ctllog.Arg("level", "Level: debug, info, warn or error.").Required().Enum("debug", "info", "warn", "error")
+		ctllogmsg   = ctllog.Arg("message", "Message.").Required().Strings()
+		ctlartifact = ctl.Command("artifact", "Register a build artifact.")
+		ctlartkind  = ctlartifact.Arg("kind", "Artifact kind, like kernel or initrd.").Required().String()
+		ctlartpath  = ctlartifact.Arg("path", "Artifact file.").Required().String()
+		ctlsecret   = ctl.Command("setsecret", "Set a secret variable for later scripts.")
+		ctlseckey   = ctlsecret.Arg("key", "Variable name.").Required().String()
+		ctlsecvalue = ctlsecret.Arg("value", "Variable value; read from stdin if omitted.").String()
+		ctlfact     = ctl.Command("fact", "Record a fact about the build.")
+		ctlfactkey  = ctlfact.Arg("key", "Fact name, like kernel.version.").Required().String()
+		ctlfactval  = ctlfact.Arg("value", "Fact value.").Required().String()
+		ctladdscr   = ctl.Command("addscript", "Add a generated build script.")
+		ctladdpath  = ctladdscr.Arg("path", "Script file in the tmp directory.").Required().String()
+		ctlappend   = ctl.Command("appendenv", "Append to a list variable for later scripts.")
+		ctlappkey   = ctlappend.Arg("key", "Variable name.").Required().String()
+		ctlappvalue = ctlappend.Arg("value", "Elements to append.").Required().String()
+		ctlappsep   = ctlappend.Flag("sep", "List separator.").String()
+		ctlprepend  = ctl.Command("prependenv", "Prepend to a list variable for later scripts.")
+		ctlprekey   = ctlprepend.Arg("key", "Variable name.").Required().String()
+		ctlprevalue = ctlprepend.Arg("value", "Elements to prepend.").Required().String()
+		ctlpresep   = ctlprepend.Flag("sep", "List separator.").String()
 	)
 
+	// Parse command line.
+	app.HelpFlag.Short('h')
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	// Control messages come from build scripts, which may well run as
+	// (fake) root.
+	var err error
+	switch cmd {
+	case ctlsetenv.FullCommand():
+		err = cmdCtl("setenv", *ctlsetkey, *ctlsetvalue, "")
+	case ctlunsetenv.FullCommand():
+		err = cmdCtl("unsetenv", *ctlunsetkey, "", "")
+	case ctllog.FullCommand():
+		err = cmdCtl("log", *ctlloglevel, strings.Join(*ctllogmsg, " "), "")
+	case ctlsecret.FullCommand():
+		value := *ctlsecvalue
+		if value == "" {
+			var data []byte
+			data, err = ioutil.ReadAll(os.Stdin)
+			value = strings.TrimSuffix(string(data), "\n")
+		}
+		if err == nil {
+			err = cmdCtl("setsecret", *ctlseckey, value, "")
+		}
+	case ctlfact.FullCommand():
+		err = cmdCtl("fact", *ctlfactkey, *ctlfactval, "")
+	case ctlappend.FullCommand():
+		err = cmdCtl("appendenv", *ctlappkey, *ctlappvalue, *ctlappsep)
+	case ctlprepend.FullCommand():
+		err = cmdCtl("prependenv", *ctlprekey, *ctlprevalue, *ctlpresep)
+	case ctladdscr.FullCommand():
+		// Relative to the work directory, like on fd 3.
+		err = cmdCtl("addscript", "", *ctladdpath, "")
+	case ctlartifact.FullCommand():
+		// Relative to the work directory, like on fd 3.
+		err = cmdCtl("artifact", *ctlartkind, *ctlartpath, "")
+	}
+	if strings.HasPrefix(cmd, ctl.FullCommand()+" ") {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rib ctl: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Don't run as root.
 	user, err := user.Current()
 	if err != nil {
@@ -268,19 +690,28 @@ func main() {
 	// Configure PATH.
 	AddSbinEnvPaths()
 
-	// Parse command line.
-	app.HelpFlag.Short('h')
-	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
-
-	// Configure logging.
-	slog := NewLogger(ioutil.Discard, "", 0)
+	// Configure logging. The console shows DEBUG messages with -v,
+	// caller information with -vv and TRACE messages with -vvv, unless a
+	// level is given. Quiet mode only hides rib's own messages, and leaves
+	// the terminal to the build scripts.
+	slog := NewLogger(nil, LevelTrace)
 	slog.SetStandard()
+	msgOut, errOut := io.Writer(os.Stdout), io.Writer(os.Stderr)
 	if *quiet {
-		os.Stdout = nil
-		os.Stderr = nil
+		msgOut, errOut = ioutil.Discard, ioutil.Discard
 	} else {
-		if *verbose >= 1 {
-			slog.AddOutput(os.Stderr)
+		switch {
+		case *loglevel != "":
+			level, err := ParseLevel(*loglevel)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			slog.AddOutput(os.Stderr, level)
+		case *verbose >= 3:
+			slog.AddOutput(os.Stderr, LevelTrace)
+		case *verbose >= 1:
+			slog.AddOutput(os.Stderr, LevelDebug)
 		}
 		if *verbose >= 2 {
 			slog.EnableDebug()
@@ -297,30 +728,99 @@ func main() {
 	switch cmd {
 	case init.FullCommand():
 		if err := cmdInit(workDir); err != nil {
-			fmt.Fprintf(os.Stderr,
+			fmt.Fprintf(errOut,
 				"Failed to initialize '%s': %s\n",
 				workDir, err)
 			os.Exit(1)
 		} else {
-			fmt.Printf("Initialized directory '%s'.\n", workDir)
+			fmt.Fprintf(msgOut, "Initialized directory '%s'.\n", workDir)
 		}
 	case build.FullCommand():
-		if err := cmdBuild(workDir, *buildseq); err != nil {
-			fmt.Fprintf(os.Stderr,
+		// The progress display would get in the way of log output
+		// on the console.
+		progress := *buildprogress
+		if progress == progressAuto && (*quiet || *verbose > 0 ||
+			*loglevel != "" || *builddryrun) {
+			progress = progressNone
+		}
+		if err := cmdBuild(workDir, &buildOptions{
+			seqmin:             *buildseq,
+			arch:               *buildarch,
+			fakerootSession:    *buildfaked,
+			fakerootCheckpoint: *buildcheckpoint,
+			dryRun:             *builddryrun,
+			answers:            *buildanswers,
+			nonInteractive:     *buildnonint,
+			strictProtocol:     *buildstrict,
+			secrets:            *buildsecrets,
+			keepBuilds:         *buildkeep,
+			maxLogAge:          *buildmaxage,
+			progress:           progress,
+			tailLines:          *buildtail,
+			report:             errOut,
+		}); err != nil {
+			fmt.Fprintf(errOut,
 				"Build failed: %s\n", err)
 			os.Exit(1)
 		}
 	case shell.FullCommand():
 		if err := cmdShell(workDir, *shellargs); err != nil {
-			fmt.Fprintf(os.Stderr,
+			fmt.Fprintf(errOut,
 				"Failed to execute shell: %s\n", err)
 			os.Exit(1)
 		}
 	case clean.FullCommand():
 		if err := cmdClean(workDir, *cleanall); err != nil {
-			fmt.Fprintf(os.Stderr,
+			fmt.Fprintf(errOut,
 				"Failed to clean: %s\n", err)
 			os.Exit(1)
 		}
+	case logls.FullCommand():
+		if err := cmdLogList(workDir); err != nil {
+			fmt.Fprintf(errOut,
+				"Failed to list builds: %s\n", err)
+			os.Exit(1)
+		}
+	case logshow.FullCommand():
+		level, err := ParseLevel(*loglvl)
+		if err == nil {
+			err = cmdLogShow(workDir, &logShowOptions{
+				build:  *logbuild,
+				script: *logscript,
+				level:  level,
+				stream: *logstream,
+				follow: *logfollow,
+			})
+		}
+		if err != nil {
+			fmt.Fprintf(errOut,
+				"Failed to show log: %s\n", err)
+			os.Exit(1)
+		}
+	case facts.FullCommand():
+		if err := cmdFacts(workDir, *factskey); err != nil {
+			fmt.Fprintf(errOut,
+				"Failed to show facts: %s\n", err)
+			os.Exit(1)
+		}
+	case fakerootls.FullCommand():
+		if err := cmdFakerootLs(workDir); err != nil {
+			fmt.Fprintf(errOut,
+				"Failed to list fakeroot state: %s\n", err)
+			os.Exit(1)
+		}
+	case fakerootverify.FullCommand():
+		if err := cmdFakerootVerify(workDir); err != nil {
+			fmt.Fprintf(errOut,
+				"Fakeroot state verification failed: %s\n", err)
+			os.Exit(1)
+		}
+	case fakerootset.FullCommand():
+		if err := cmdFakerootSet(workDir, *fakerootpath,
+			*fakerootowner, *fakerootmode); err != nil {
+			fmt.Fprintf(errOut,
+				"Failed to set fakeroot state: %s\n", err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Replacement for secret values in output.
+const secretMask = "********"
+
+// Secret values, masked in all log output. They are only kept in memory.
+var secrets struct {
+	sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+}
+
+// AddSecret registers a value to be masked in all log output.
+func AddSecret(value string) {
+	if value == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+
+	// Replace longer values first, in case one contains another.
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+	var oldnew []string
+	for _, v := range secrets.values {
+		oldnew = append(oldnew, v, secretMask)
+	}
+	secrets.replacer = strings.NewReplacer(oldnew...)
+}
+
+// MaskSecrets replaces all registered secret values in the string.
+func MaskSecrets(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// setSecret sets a secret variable in the persistent command environment.
+func setSecret(key, value string) {
+	AddSecret(value)
+	cmdPersistEnv[key] = value
+	delete(cmdPersistLists, key)
+}
+
+// LoadSecrets reads secret variables from a file of "KEY=VALUE" lines, which
+// must be outside the work directory, so that it does not end up in copies
+// or archives of it.
+func LoadSecrets(workDir, pathname string) error {
+	realPath, err := filepath.EvalSymlinks(pathname)
+	if err != nil {
+		return err
+	}
+	realPath, err = filepath.Abs(realPath)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(workDir, realPath); err == nil &&
+		rel != ".." && !strings.HasPrefix(rel, "../") {
+		return errors.New("secrets file must be outside the work directory")
+	}
+
+	fi, err := os.Stat(realPath)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&077 != 0 {
+		Warningf("Secrets file '%s' is accessible by other users.",
+			pathname)
+	}
+
+	f, err := os.Open(realPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Parse the file like the configuration file, but without quoting
+	// malformed lines in errors.
+	var keys []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return fmt.Errorf("%s: line %d: missing '='", pathname, n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !envKeyRe.MatchString(key) {
+			return fmt.Errorf("%s: line %d: invalid environment "+
+				"variable name", pathname, n)
+		}
+		setSecret(key, strings.TrimSpace(line[i+1:]))
+		keys = append(keys, key)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	Infof("Loaded secrets from '%s': %s", pathname, strings.Join(keys, " "))
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+// resetSecrets forgets all registered secret values, so that tests do not
+// affect each other.
+func resetSecrets() {
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values = nil
+	secrets.replacer = nil
+}
+
+func TestMaskSecrets(t *testing.T) {
+	defer resetSecrets()
+	AddSecret("hunter2")
+	AddSecret("pass")
+	AddSecret("password1")
+	AddSecret("")
+	tests := []struct {
+		in, want string
+	}{
+		{"no secrets here", "no secrets here"},
+		{"token=hunter2", "token=" + secretMask},
+		{"password1 or pass", secretMask + " or " + secretMask},
+		{"hunter2hunter2", secretMask + secretMask},
+	}
+	for _, test := range tests {
+		if got := MaskSecrets(test.in); got != test.want {
+			t.Errorf("MaskSecrets(%q): got %q, want %q", test.in,
+				got, test.want)
+		}
+	}
+}
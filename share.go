@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Directory inside the chroot holding shared rib directories.
+const shareBaseDir = "/.rib"
+
+// Rib directories shared into the chroot by default.
+var defaultShares = []string{PATHNAME_FILES, PATHNAME_DIST, PATHNAME_BIN}
+
+// A Share is a host file or directory made available inside the chroot. It
+// is copied in before the command runs, and removed afterwards. A writable
+// share is synced back to the host first. Default shares are implicit, and
+// only copied for scripts that use them.
+type Share struct {
+	source   string
+	target   string
+	writable bool
+	envvar   string
+	implicit bool
+}
+
+func (s Share) String() string {
+	mode := "ro"
+	if s.writable {
+		mode = "rw"
+	}
+	return fmt.Sprintf("%s:%s:%s", s.source, s.target, mode)
+}
+
+// parseShare parses a share specification on the form
+// "source[:target][:ro|rw]". The source is either the name of a rib
+// directory, like "files", or an absolute host path.
+func parseShare(spec string) (Share, error) {
+	var s Share
+	parts := strings.Split(spec, ":")
+	if n := len(parts); n > 1 && (parts[n-1] == "ro" || parts[n-1] == "rw") {
+		s.writable = parts[n-1] == "rw"
+		parts = parts[:n-1]
+	}
+	if len(parts) > 2 || parts[0] == "" {
+		return s, fmt.Errorf("invalid share %q", spec)
+	}
+	s.source = parts[0]
+
+	if filepath.IsAbs(s.source) {
+		s.source = filepath.Clean(s.source)
+		s.target = filepath.Join(shareBaseDir, filepath.Base(s.source))
+	} else {
+		for _, d := range dirSkeleton {
+			if d.pathname == s.source && d.filetype == FILETYPE_DIR &&
+				d.pathname != PATHNAME_ROOTFS {
+				s.envvar = d.envvar
+			}
+		}
+		if s.envvar == "" {
+			return s, fmt.Errorf("unknown rib directory in share %q",
+				spec)
+		}
+		s.target = filepath.Join(shareBaseDir, s.source)
+	}
+
+	if len(parts) == 2 {
+		if !filepath.IsAbs(parts[1]) {
+			return s, fmt.Errorf("share target must be absolute: %q",
+				spec)
+		}
+		s.target = filepath.Clean(parts[1])
+	}
+	if s.target == "/" {
+		return s, fmt.Errorf("cannot share onto the chroot root: %q", spec)
+	}
+	return s, nil
+}
+
+// parseShares collects the share directives, starting from the default rib
+// directory shares. The value "none" removes all shares declared so far, and
+// a share replaces any earlier one with the same target.
+func parseShares(d Directives) ([]Share, error) {
+	var shares []Share
+	add := func(s Share) {
+		for i := range shares {
+			if shares[i].target == s.target {
+				shares[i] = s
+				return
+			}
+		}
+		shares = append(shares, s)
+	}
+
+	for _, spec := range defaultShares {
+		s, err := parseShare(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.implicit = true
+		add(s)
+	}
+	for _, spec := range d["share"] {
+		if spec == "none" {
+			shares = nil
+			continue
+		}
+		s, err := parseShare(spec)
+		if err != nil {
+			return nil, err
+		}
+		add(s)
+	}
+
+	// A share inside another one would be copied into it.
+	for i := range shares {
+		for j := range shares {
+			if i != j && isWithin(shares[i].target, shares[j].target) {
+				return nil, fmt.Errorf("share target '%s' is "+
+					"inside share target '%s'",
+					shares[i].target, shares[j].target)
+			}
+		}
+	}
+	return shares, nil
+}
+
+// isWithin reports whether a clean absolute path is below a directory.
+func isWithin(pathname, dir string) bool {
+	rel, err := filepath.Rel(dir, pathname)
+	return err == nil && rel != "." && rel != ".." &&
+		!strings.HasPrefix(rel, "../")
+}
+
+// DropUnusedShares removes the default shares that neither the script nor
+// its companion files mention, by environment variable or target, so that
+// their contents are not copied into the chroot for every script. Declared
+// shares are always kept.
+func (ce *CmdEnv) DropUnusedShares() error {
+	var files [][]byte
+	read := func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(pathname)
+			if err != nil {
+				return err
+			}
+			files = append(files, data)
+		}
+		return nil
+	}
+	for _, pathname := range append([]string{ce.Path}, ce.companions...) {
+		if err := filepath.Walk(pathname, read); err != nil {
+			return err
+		}
+	}
+
+	shares := ce.shares[:0]
+	for _, s := range ce.shares {
+		used := !s.implicit
+		for _, data := range files {
+			if used {
+				break
+			}
+			used = bytes.Contains(data, []byte(s.envvar)) ||
+				bytes.Contains(data, []byte(s.target))
+		}
+		if used {
+			shares = append(shares, s)
+		}
+	}
+	ce.shares = shares
+	return nil
+}
+
+// copyTree copies a file or directory tree, preserving attributes. An
+// existing destination directory receives the contents of the source.
+func copyTree(dst, src string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := EnsureDir(dst); err != nil {
+			return err
+		}
+		src += "/."
+	}
+	// Like CopyFile, rely on cp for attribute-preserving copies.
+	out, err := exec.Command("cp", "-a", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cp: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// syncTree makes dst a copy of src, like copyTree, but also removes the
+// files in dst that are not in src, or that have another file type.
+func syncTree(dst, src string) error {
+	err := filepath.Walk(dst, func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dst, pathname)
+		if err != nil || rel == "." {
+			return err
+		}
+		sfi, err := os.Lstat(filepath.Join(src, rel))
+		if err == nil && sfi.Mode()&os.ModeType == fi.Mode()&os.ModeType {
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(pathname); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return copyTree(dst, src)
+}
+
+// A shareStamp identifies the state of a file in a share, to detect changes.
+type shareStamp struct {
+	mode  os.FileMode
+	size  int64
+	mtime syscall.Timespec
+	ctime syscall.Timespec
+}
+
+// stampTree records the state of all files in a tree, by path. The change
+// time catches writes that restore the modification time.
+func stampTree(root string) (map[string]shareStamp, error) {
+	stamps := make(map[string]shareStamp)
+	err := filepath.Walk(root, func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("stat unavailable for '%s'", pathname)
+		}
+		stamps[pathname[len(root):]] = shareStamp{fi.Mode(), fi.Size(),
+			st.Mtim, st.Ctim}
+		return nil
+	})
+	return stamps, err
+}
+
+// changedPaths lists the paths that differ between two sets of stamps.
+func changedPaths(before, after map[string]shareStamp) []string {
+	var changed []string
+	for p, st := range after {
+		if old, ok := before[p]; !ok || old != st {
+			changed = append(changed, p)
+		}
+	}
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// An activeShare is a share copied into the chroot, with the host path of
+// the copy, and the state of a read-only copy right after it was made.
+type activeShare struct {
+	Share
+	dst    string
+	stamps map[string]shareStamp
+}
+
+// A createdDir is a directory created in the chroot for a share target, by
+// its path inside the chroot and its host path.
+type createdDir struct {
+	path string
+	host string
+}
+
+// stillInRoot reports whether a path inside the chroot still resolves to the
+// given host path. The command may have replaced a directory on the way with
+// a symlink, which would lead outside the rootfs when followed on the host.
+func (ce *CmdEnv) stillInRoot(pathname, host string) bool {
+	resolved, err := ResolveInRoot(ce.chrootDir, pathname)
+	return err == nil && resolved == host
+}
+
+// resolveShareTarget returns the host path of a share target, with its
+// parent directory resolved within the rootfs. Missing parent directories
+// are created, and returned.
+func (ce *CmdEnv) resolveShareTarget(target string) (string, []createdDir, error) {
+	dir := filepath.Dir(target)
+	var missing []string
+	var hostDir string
+	for {
+		resolved, err := ResolveInRoot(ce.chrootDir, dir)
+		if err == nil {
+			hostDir = resolved
+			break
+		}
+		if !os.IsNotExist(err) || dir == "/" {
+			return "", nil, err
+		}
+		missing = append([]string{filepath.Base(dir)}, missing...)
+		dir = filepath.Dir(dir)
+	}
+
+	var created []createdDir
+	for _, name := range missing {
+		dir = filepath.Join(dir, name)
+		hostDir = filepath.Join(hostDir, name)
+		if err := os.Mkdir(hostDir, 0755); err != nil {
+			return "", created, err
+		}
+		created = append(created, createdDir{dir, hostDir})
+	}
+	return filepath.Join(hostDir, filepath.Base(target)), created, nil
+}
+
+// removeStaleShares removes the share directory left in the rootfs by a
+// command that was interrupted before removing its shares.
+func (ce *CmdEnv) removeStaleShares() error {
+	dir := filepath.Join(ce.chrootDir, shareBaseDir)
+	if _, err := os.Lstat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	Warningf("Removing '%s' left in the rootfs by an interrupted build.",
+		shareBaseDir)
+	return os.RemoveAll(dir)
+}
+
+// SetupShares copies the shared host directories into the chroot. The
+// returned function removes all shares from the chroot; it must be called
+// after the command has finished. Writable shares are first synced back to
+// the host, and changes to read-only shares fail the command.
+func (ce *CmdEnv) SetupShares() (teardown func() error, err error) {
+	var active []activeShare
+	var created []createdDir
+
+	teardown = func() error {
+		var err error
+		for _, a := range active {
+			if !ce.stillInRoot(a.target, a.dst) {
+				Errorf("Share '%s' was replaced; leaving it in "+
+					"the rootfs.", a.target)
+				err = fmt.Errorf("share '%s' was replaced", a.target)
+				continue
+			}
+			if a.writable {
+				Debugf("Copying share '%s' back to '%s'.",
+					a.target, ce.shareSource(a.Share))
+				if cerr := syncTree(ce.shareSource(a.Share),
+					a.dst); cerr != nil {
+					// Keep the share to avoid losing data.
+					Errorf("Copying share '%s' back: %s",
+						a.target, cerr)
+					err = cerr
+					continue
+				}
+			} else if a.stamps != nil {
+				stamps, serr := stampTree(a.dst)
+				if serr == nil {
+					if c := changedPaths(a.stamps, stamps); len(c) > 0 {
+						for i := range c {
+							c[i] = a.target + c[i]
+						}
+						Errorf("Read-only share '%s' was "+
+							"modified: %s", a.target,
+							strings.Join(c, ", "))
+						serr = fmt.Errorf("read-only share "+
+							"'%s' was modified", a.target)
+					}
+				}
+				if serr != nil && err == nil {
+					err = serr
+				}
+			}
+			if rerr := os.RemoveAll(a.dst); rerr != nil {
+				Errorf("Removing share '%s': %s", a.target, rerr)
+			}
+		}
+		// Remove created parent directories, innermost first.
+		for i := len(created) - 1; i >= 0; i-- {
+			if ce.stillInRoot(created[i].path, created[i].host) {
+				os.Remove(created[i].host)
+			}
+		}
+		return err
+	}
+
+	if err := ce.removeStaleShares(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range ce.shares {
+		src := ce.shareSource(s)
+		if _, err := os.Stat(src); err != nil {
+			teardown()
+			return nil, err
+		}
+		dst, dirs, err := ce.resolveShareTarget(s.target)
+		created = append(created, dirs...)
+		if err != nil {
+			teardown()
+			return nil, err
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			teardown()
+			return nil, fmt.Errorf("share target '%s' already exists "+
+				"in rootfs", s.target)
+		}
+
+		Debugf("Sharing '%s' as '%s'.", src, s.target)
+		active = append(active, activeShare{Share: s, dst: dst})
+		if err := copyTree(dst, src); err != nil {
+			teardown()
+			return nil, err
+		}
+		if !s.writable {
+			a := &active[len(active)-1]
+			if a.stamps, err = stampTree(dst); err != nil {
+				teardown()
+				return nil, err
+			}
+		}
+	}
+
+	return teardown, nil
+}
+
+// shareSource returns the host path of a share.
+func (ce *CmdEnv) shareSource(s Share) string {
+	if filepath.IsAbs(s.source) {
+		return s.source
+	}
+	return filepath.Join(ce.workDir, s.source)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSharesOverlap(t *testing.T) {
+	if _, err := parseShares(Directives{
+		"share": {"/srv/a:/opt/a", "/srv/b:/opt/a/b"},
+	}); err == nil {
+		t.Fatalf("Nested share targets were accepted.")
+	}
+	shares, err := parseShares(Directives{
+		"share": {"/srv/a:/opt/a", "/srv/b:/opt/ab"},
+	})
+	if err != nil {
+		t.Fatalf("parseShares failed: %s", err)
+	}
+	if len(shares) != len(defaultShares)+2 {
+		t.Fatalf("Got %d shares, want %d", len(shares),
+			len(defaultShares)+2)
+	}
+}
+
+func TestSyncTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	for _, d := range []string{"src/keep", "dst/keep", "dst/gone",
+		"dst/type"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"src/keep/a", "src/new", "src/type",
+		"dst/keep/a", "dst/keep/old", "dst/gone/b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := syncTree(dst, src); err != nil {
+		t.Fatalf("syncTree failed: %s", err)
+	}
+	stamps, err := stampTree(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", "/keep", "/keep/a", "/new", "/type"}
+	if len(stamps) != len(want) {
+		t.Fatalf("Got %v, want %v", stamps, want)
+	}
+	for _, p := range want {
+		if _, ok := stamps[p]; !ok {
+			t.Fatalf("Missing '%s' in %v", p, stamps)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dst, "keep/a"))
+	if err != nil || string(data) != "src/keep/a" {
+		t.Fatalf("keep/a: got %q, %v", data, err)
+	}
+}
+
+func TestResolveShareTarget(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	// A symlinked parent directory is followed within the rootfs.
+	if err := os.Mkdir(filepath.Join(rootfs, "usr"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/", filepath.Join(rootfs, "up")); err != nil {
+		t.Fatal(err)
+	}
+	ce := &CmdEnv{chrootDir: rootfs}
+	dst, created, err := ce.resolveShareTarget("/up/usr/new/share")
+	if err != nil {
+		t.Fatalf("resolveShareTarget failed: %s", err)
+	}
+	if want := filepath.Join(rootfs, "usr/new/share"); dst != want {
+		t.Fatalf("Got '%s', want '%s'", dst, want)
+	}
+	if len(created) != 1 || created[0].path != "/up/usr/new" ||
+		!ce.stillInRoot(created[0].path, created[0].host) {
+		t.Fatalf("Created %+v", created)
+	}
+
+	// Replacing a directory with a symlink is detected.
+	if err := os.Remove(created[0].host); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", created[0].host); err != nil {
+		t.Fatal(err)
+	}
+	if ce.stillInRoot(created[0].path, created[0].host) {
+		t.Fatalf("Replaced directory still reported in place.")
+	}
+}
+
+func TestDropUnusedShares(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "10-C-script")
+	companion := filepath.Join(dir, "10-C-script.d")
+	if err := os.Mkdir(companion, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\n. ./lib.sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(companion, "lib.sh"),
+		[]byte("cp \"$RIB_DIR_FILES/motd\" /etc\nls /.rib/bin\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := parseShares(Directives{"share": {"/srv/a:/opt/a"}})
+	if err != nil {
+		t.Fatalf("parseShares failed: %s", err)
+	}
+	ce := &CmdEnv{companions: []string{companion}, shares: shares}
+	ce.Path = script
+	if err := ce.DropUnusedShares(); err != nil {
+		t.Fatalf("DropUnusedShares failed: %s", err)
+	}
+	var targets []string
+	for _, s := range ce.shares {
+		targets = append(targets, s.target)
+	}
+	if got, want := strings.Join(targets, " "),
+		"/.rib/files /.rib/bin /opt/a"; got != want {
+		t.Fatalf("Got shares %s, want %s", got, want)
+	}
+}
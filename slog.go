@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -8,14 +9,62 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// A Level is the severity of a log message.
+type Level int
+
+// Log levels, from the most to the least verbose.
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"TRACE", "DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelTrace || l > LevelError {
+		return fmt.Sprintf("LEVEL%d", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, like "debug" or "warning", ignoring case.
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToUpper(s)
+	if s == "WARN" {
+		return LevelWarning, nil
+	}
+	for l, name := range levelNames {
+		if s == name {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// A logSink is an output of a logger, receiving messages at or above its
+// level, as text lines, JSON objects or function calls.
+type logSink struct {
+	out   io.Writer
+	level Level
+	json  bool
+	fn    func(Level, string)
+}
+
 // A SimpleLogger represents a logging object that generates lines of output to
-// an io.Writer. It includes a debug flag to control output of debug messages.
+// a number of sinks, each with its own level. It includes a debug flag to add
+// caller information to text output.
 type SimpleLogger struct {
-	out   io.Writer
-	debug bool
+	sinks  []logSink
+	debug  bool
+	script string
+	mu     sync.Mutex
 }
 
 // EnableDebug enables the debug flag on the logger.
@@ -23,48 +72,107 @@ func (l *SimpleLogger) EnableDebug() {
 	l.debug = true
 }
 
-// NewLogger creates a new SimpleLogger.
-func NewLogger(out io.Writer, prefix string, flag int) *SimpleLogger {
-	return &SimpleLogger{out: out, debug: false}
+// SetScript sets the name of the running build script, which is included in
+// JSON output.
+func (l *SimpleLogger) SetScript(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.script = name
 }
 
-var Std = NewLogger(os.Stdout, "", 0)
+// NewLogger creates a new SimpleLogger, writing text lines at or above the
+// given level to out. A nil writer yields a logger without sinks.
+func NewLogger(out io.Writer, level Level) *SimpleLogger {
+	l := &SimpleLogger{}
+	if out != nil {
+		l.AddOutput(out, level)
+	}
+	return l
+}
+
+var Std = NewLogger(os.Stdout, LevelTrace)
+
+// A jsonLogLine is a log message in a JSON sink.
+type jsonLogLine struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Msg    string `json:"msg"`
+	Caller string `json:"caller,omitempty"`
+	Script string `json:"script,omitempty"`
+}
+
+// Output writes the output for a logging event to the sinks whose level it
+// meets. It is a simple adaption of https://golang.org/pkg/log/#Output
+func (l *SimpleLogger) Output(calldepth int, level Level, s string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wanted, wantCaller := false, l.debug
+	for _, sink := range l.sinks {
+		if level >= sink.level {
+			wanted = true
+			wantCaller = wantCaller || sink.json
+		}
+	}
+	if !wanted {
+		return nil
+	}
 
-// Output writes the output for a logging event. It is a simple adaption of
-// https://golang.org/pkg/log/#Output
-func (l *SimpleLogger) Output(calldepth int, s string) error {
-	now := time.Now()
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
 
-	if s[len(s)-1] == '\n' {
+	if len(s) > 0 && s[len(s)-1] == '\n' {
 		s = s[0 : len(s)-1]
 	}
-	qs := strings.Trim(strconv.QuoteToASCII(string(s)), `"`)
+	s = MaskSecrets(s)
 
-	var os string
-	if l.debug {
-		var fname string
+	var caller string
+	if wantCaller {
 		pc, file, line, ok := runtime.Caller(calldepth)
 		if ok {
-			file = filepath.Base(file)
-			fname = runtime.FuncForPC(pc).Name()
+			caller = fmt.Sprintf("%s:%s():%d", filepath.Base(file),
+				runtime.FuncForPC(pc).Name(), line)
 		} else {
-			file = "???"
-			line = 0
-			fname = "???"
+			caller = "???:???():0"
 		}
-		os = fmt.Sprintf("%s %s:%s():%d %s\n",
-			now.UTC().Format("2006-01-02T15:04:05.000Z"),
-			file, fname, line,
-			qs,
-		)
+	}
+
+	qs := strings.Trim(strconv.QuoteToASCII(level.String()+" "+s), `"`)
+	var text string
+	if l.debug {
+		text = fmt.Sprintf("%s %s %s\n", now, caller, qs)
 	} else {
-		os = fmt.Sprintf("%s %s\n",
-			now.UTC().Format("2006-01-02T15:04:05.000Z"),
-			qs,
-		)
+		text = fmt.Sprintf("%s %s\n", now, qs)
 	}
 
-	_, err := l.out.Write([]byte(os))
+	var err error
+	for _, sink := range l.sinks {
+		if level < sink.level {
+			continue
+		}
+		if sink.fn != nil {
+			sink.fn(level, s)
+			continue
+		}
+		var data []byte
+		if sink.json {
+			data, err = json.Marshal(jsonLogLine{
+				Time:   now,
+				Level:  level.String(),
+				Msg:    s,
+				Caller: caller,
+				Script: l.script,
+			})
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+		} else {
+			data = []byte(text)
+		}
+		if _, werr := sink.out.Write(data); werr != nil {
+			err = werr
+		}
+	}
 	return err
 }
 
@@ -73,37 +181,92 @@ func (l *SimpleLogger) SetStandard() {
 	Std = l
 }
 
-// SetOutput sets the given writer as the output.
-func (l *SimpleLogger) SetOutput(w io.Writer) {
-	l.out = w
+// AddOutput adds the given writer to the logger output, as a text sink for
+// messages at or above the given level.
+func (l *SimpleLogger) AddOutput(w io.Writer, level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = append(l.sinks, logSink{out: w, level: level})
 }
 
-// AddOutput adds the given writer to the logger output.
-func (l *SimpleLogger) AddOutput(w io.Writer) {
-	l.out = io.MultiWriter(l.out, w)
+// AddJSONOutput adds the given writer to the logger output, as a JSON sink
+// for messages at or above the given level.
+func (l *SimpleLogger) AddJSONOutput(w io.Writer, level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = append(l.sinks, logSink{out: w, level: level, json: true})
+}
+
+// AddFuncOutput adds the given function to the logger output, to be called
+// with messages at or above the given level. It must not log itself.
+func (l *SimpleLogger) AddFuncOutput(fn func(Level, string), level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = append(l.sinks, logSink{level: level, fn: fn})
+}
+
+// RemoveFuncOutputs removes the sinks calling functions.
+func (l *SimpleLogger) RemoveFuncOutputs() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sinks := l.sinks[:0]
+	for _, sink := range l.sinks {
+		if sink.fn == nil {
+			sinks = append(sinks, sink)
+		}
+	}
+	l.sinks = sinks
+}
+
+// RemoveOutput removes the sinks writing to the given writer.
+func (l *SimpleLogger) RemoveOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sinks := l.sinks[:0]
+	for _, sink := range l.sinks {
+		if sink.fn != nil || sink.out != w {
+			sinks = append(sinks, sink)
+		}
+	}
+	l.sinks = sinks
 }
 
 // AddLoggerOutput adds the given writer to the standard logger output.
-func AddLoggerOutput(w io.Writer) {
-	Std.out = io.MultiWriter(Std.out, w)
+func AddLoggerOutput(w io.Writer, level Level) {
+	Std.AddOutput(w, level)
+}
+
+// Transcript is the logger for session transcripts of interactive commands.
+// The user already sees the session, so it only goes to the build log.
+var Transcript = NewLogger(nil, LevelTrace)
+
+// Transcriptf calls Output to print to the transcript logger at the DEBUG
+// level.
+func Transcriptf(format string, v ...interface{}) {
+	Transcript.Output(2, LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Tracef calls Output to print to the standard logger at the TRACE level.
+func Tracef(format string, v ...interface{}) {
+	Std.Output(2, LevelTrace, fmt.Sprintf(format, v...))
 }
 
-// Debugf calls Output to print to the standard logger with a "DEBUG" prefix.
+// Debugf calls Output to print to the standard logger at the DEBUG level.
 func Debugf(format string, v ...interface{}) {
-	Std.Output(2, fmt.Sprintf("DEBUG "+format, v...))
+	Std.Output(2, LevelDebug, fmt.Sprintf(format, v...))
 }
 
-// Debugf calls Output to print to the standard logger with a "INFO" prefix.
+// Infof calls Output to print to the standard logger at the INFO level.
 func Infof(format string, v ...interface{}) {
-	Std.Output(2, fmt.Sprintf("INFO "+format, v...))
+	Std.Output(2, LevelInfo, fmt.Sprintf(format, v...))
 }
 
-// Debugf calls Output to print to the standard logger with a "WARNING" prefix.
+// Warningf calls Output to print to the standard logger at the WARNING level.
 func Warningf(format string, v ...interface{}) {
-	Std.Output(2, fmt.Sprintf("WARNING "+format, v...))
+	Std.Output(2, LevelWarning, fmt.Sprintf(format, v...))
 }
 
-// Debugf calls Output to print to the standard logger with a "ERROR" prefix.
+// Errorf calls Output to print to the standard logger at the ERROR level.
 func Errorf(format string, v ...interface{}) {
-	Std.Output(2, fmt.Sprintf("ERROR "+format, v...))
+	Std.Output(2, LevelError, fmt.Sprintf(format, v...))
 }
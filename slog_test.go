@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	var console, file, js bytes.Buffer
+	l := NewLogger(&console, LevelInfo)
+	l.AddOutput(&file, LevelDebug)
+	l.AddJSONOutput(&js, LevelTrace)
+
+	l.Output(1, LevelTrace, "trace")
+	l.Output(1, LevelDebug, "debug")
+	l.Output(1, LevelInfo, "info\n")
+
+	if got := strings.Count(console.String(), "\n"); got != 1 ||
+		!strings.HasSuffix(console.String(), " INFO info\n") {
+		t.Errorf("console sink: got %q", console.String())
+	}
+	if got := strings.Count(file.String(), "\n"); got != 2 ||
+		!strings.Contains(file.String(), " DEBUG debug\n") {
+		t.Errorf("file sink: got %q", file.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(js.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("JSON sink: got %d lines, want 3", len(lines))
+	}
+	var m jsonLogLine
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("JSON sink: %s", err)
+	}
+	if m.Level != "TRACE" || m.Msg != "trace" ||
+		!strings.HasPrefix(m.Caller, "slog_test.go:") {
+		t.Errorf("JSON sink: got %+v", m)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]Level{
+		"trace":   LevelTrace,
+		"DEBUG":   LevelDebug,
+		"Info":    LevelInfo,
+		"warn":    LevelWarning,
+		"warning": LevelWarning,
+		"error":   LevelError,
+	}
+	for s, want := range tests {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q): got %s, %v, want %s", s, got,
+				err, want)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("ParseLevel(%q): got no error", "loud")
+	}
+}
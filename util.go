@@ -25,6 +25,15 @@ const (
 	PATHNAME_TMP          = "tmp"
 	PATHNAME_LOG          = "log"
 	PATHNAME_FAKEROOTSAVE = "fakeroot.save"
+
+	PATHNAME_FAKEROOTPATHS = "fakeroot.paths"
+	PATHNAME_CONFIG        = "rib.conf"
+	PATHNAME_ARTIFACTS     = "artifacts.json"
+	PATHNAME_FACTS         = "facts.json"
+	PATHNAME_BUILDS        = "builds"
+	PATHNAME_BUILDLOG      = "build.log"
+	PATHNAME_BUILDJSON     = "build.json"
+	PATHNAME_BUILDSTATUS   = "status.json"
 )
 
 // The rib directory skeleton.